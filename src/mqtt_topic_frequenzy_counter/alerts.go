@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+const (
+	ALERT_SILENT    = "silent"
+	ALERT_RECOVERED = "recovered"
+	ALERT_RULE      = "rule"
+
+	NOTIFY_TIMEOUT = 30 * time.Second
+)
+
+/*
+mqtt_topic: alerts are published here as json
+webhook: url, alerts are POSTed there as json
+exec: command & arguments, started once per alert with the json on stdin
+
+Nothing configured = alerts are only logged
+*/
+type SettingsNotify struct {
+	MqttTopic string   `yaml:"mqtt_topic"`
+	Webhook   string   `yaml:"webhook"`
+	Exec      []string `yaml:"exec"`
+}
+
+func (n SettingsNotify) isEmpty() bool {
+	return len(n.MqttTopic) == 0 && len(n.Webhook) == 0 && len(n.Exec) == 0
+}
+
+type Alert struct {
+	Kind         string    `json:"kind"`
+	FriendlyName string    `json:"friendly_name"`
+	Topic        string    `json:"topic"`
+	Message      string    `json:"message"`
+	Time         time.Time `json:"time"`
+	Rule         string    `json:"rule,omitempty"`
+	Value        uint64    `json:"value,omitempty"`
+	Limit        uint64    `json:"limit,omitempty"`
+}
+
+/* Logs the alert and hands it to every configured notification channel */
+func (a Alert) dispatch(n SettingsNotify) {
+	WarningLogger.Printf("ALERT [%s] %s: %s\n", a.Kind, a.FriendlyName, a.Message)
+
+	// a replay only logs, the alerts are about data long gone
+	if n.isEmpty() || replaying {
+		return
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return
+	}
+
+	if len(n.MqttTopic) > 0 {
+		if err = publishMessage(n.MqttTopic, b, false); err != nil {
+			ErrorLogger.Printf("Publishing alert to %s failed: %s\n", n.MqttTopic, err)
+		}
+	}
+	if len(n.Webhook) > 0 {
+		if err = postWebhook(n.Webhook, b); err != nil {
+			ErrorLogger.Printf("Alert webhook %s failed: %s\n", n.Webhook, err)
+		}
+	}
+	if len(n.Exec) > 0 {
+		if err = execNotify(n.Exec, b); err != nil {
+			ErrorLogger.Printf("Alert command %s failed: %s\n", n.Exec[0], err)
+		}
+	}
+}
+
+func postWebhook(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func execNotify(command []string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
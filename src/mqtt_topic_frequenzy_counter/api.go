@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Max size of a request body, a watch entry is far below */
+const API_MAX_BODY = 64 * 1024
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiTopic struct {
+	Topic         string                `json:"topic"`
+	Messages      uint32                `json:"messages"`
+	Bytes         uint64                `json:"bytes"`
+	TotalMessages uint32                `json:"total_messages"`
+	TotalBytes    uint64                `json:"total_bytes"`
+	LastSeen      *time.Time            `json:"last_seen,omitempty"`
+	Rates         map[string]windowRate `json:"rates"`
+}
+
+type apiTopics struct {
+	FriendlyName string     `json:"friendly_name"`
+	WindowStart  time.Time  `json:"window_start"`
+	Count        int        `json:"count"`
+	Topics       []apiTopic `json:"topics"`
+}
+
+/* One bucket of a retention tier, Messages & Bytes are summed up over the samples within it */
+type apiPoint struct {
+	Start    time.Time `json:"start"`
+	Samples  uint32    `json:"samples"`
+	Messages uint64    `json:"messages"`
+	Bytes    uint64    `json:"bytes"`
+}
+
+type apiSeries struct {
+	FriendlyName string     `json:"friendly_name"`
+	Topic        string     `json:"topic,omitempty"`
+	Resolution   string     `json:"resolution"`
+	Points       []apiPoint `json:"points"`
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ErrorLogger.Println(err)
+	}
+}
+
+/* Maps the errors of supervisor.execute to status codes */
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errBadCommand):
+		status = http.StatusBadRequest
+	case errors.Is(err, errUnknownWatch):
+		status = http.StatusNotFound
+	case errors.Is(err, errWatchExists):
+		status = http.StatusConflict
+	}
+	writeJSONResponse(w, status, apiError{Error: err.Error()})
+}
+
+/* Runs a control command & writes its result */
+func apiExecute(w http.ResponseWriter, cmd controlCommand, status int) {
+	result, err := topicSupervisor.execute(cmd)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSONResponse(w, status, result)
+}
+
+/* Requests changing something need the token, registerAPI leaves them out without one */
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONResponse(w, http.StatusUnauthorized, apiError{Error: "missing or wrong token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func apiWatch(w http.ResponseWriter, r *http.Request) *TopicProc {
+	name := r.PathValue("name")
+	tp := findTopicProc(name)
+	if tp == nil {
+		writeAPIError(w, fmt.Errorf("%w %q", errUnknownWatch, name))
+	}
+	return tp
+}
+
+func handleAPIWatches(w http.ResponseWriter, r *http.Request) {
+	procs := currentTopicProcs()
+	infos := make([]watchInfo, 0, len(procs))
+	for _, tp := range procs {
+		infos = append(infos, tp.info())
+	}
+	writeJSONResponse(w, http.StatusOK, infos)
+}
+
+func handleAPIWatch(w http.ResponseWriter, r *http.Request) {
+	if tp := apiWatch(w, r); tp != nil {
+		writeJSONResponse(w, http.StatusOK, tp.info())
+	}
+}
+
+/* Body is a topics entry of the settings file as JSON */
+func handleAPIAddWatch(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	if err != nil {
+		writeAPIError(w, fmt.Errorf("%w: %w", errBadCommand, err))
+		return
+	}
+	apiExecute(w, controlCommand{Command: CONTROL_ADD_WATCH, Watch: body}, http.StatusCreated)
+}
+
+func handleAPIRemoveWatch(w http.ResponseWriter, r *http.Request) {
+	apiExecute(w, controlCommand{Command: CONTROL_REMOVE_WATCH, FriendlyName: r.PathValue("name")}, http.StatusOK)
+}
+
+/* reset & snapshot, of every entry or the one in the path */
+func handleAPICommand(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiExecute(w, controlCommand{Command: command, FriendlyName: r.PathValue("name")}, http.StatusOK)
+	}
+}
+
+/* Body: {"pattern": "..."} */
+func handleAPIExclude(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Pattern string `json:"pattern"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_MAX_BODY)).Decode(&body); err != nil {
+		writeAPIError(w, fmt.Errorf("%w: %w", errBadCommand, err))
+		return
+	}
+	apiExecute(w, controlCommand{Command: CONTROL_EXCLUDE, FriendlyName: r.PathValue("name"), Pattern: body.Pattern}, http.StatusOK)
+}
+
+func handleAPITop(w http.ResponseWriter, r *http.Request) {
+	n, err := apiIntParam(r, "n")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	apiExecute(w, controlCommand{Command: CONTROL_DUMP_TOP, FriendlyName: r.PathValue("name"), N: n}, http.StatusOK)
+}
+
+func apiIntParam(r *http.Request, key string) (int, error) {
+	raw := r.URL.Query().Get(key)
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %s has to be a positive number", errBadCommand, key)
+	}
+	return n, nil
+}
+
+/*
+Current & alltime counters of every topic.
+?sort= & ?order= like the table page, ?prefix= only topics starting with it, ?limit= the first n after sorting
+*/
+func handleAPITopics(w http.ResponseWriter, r *http.Request) {
+	tp := apiWatch(w, r)
+	if tp == nil {
+		return
+	}
+	limit, err := apiIntParam(r, "limit")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	rows := tp.snapshotRows()
+	sortTopicRows(rows, query.Get("sort"), strings.EqualFold(query.Get("order"), "asc"))
+
+	windowStart := tp.currentWindowStart(clock.Now())
+	windows := tp.windowNames()
+	res := apiTopics{FriendlyName: tp.friendlyName, WindowStart: windowStart, Topics: make([]apiTopic, 0)}
+	for _, row := range rows {
+		if !strings.HasPrefix(row.Topic, prefix) {
+			continue
+		}
+		res.Count++
+		if limit > 0 && len(res.Topics) >= limit {
+			continue
+		}
+		t := apiTopic{
+			Topic:         row.Topic,
+			Messages:      row.Messages,
+			Bytes:         row.Bytes,
+			TotalMessages: row.TotalMessages,
+			TotalBytes:    row.TotalBytes,
+			Rates:         make(map[string]windowRate, len(windows)),
+		}
+		if !row.LastSeen.IsZero() {
+			t.LastSeen = &row.LastSeen
+		}
+		for idx, rate := range row.Rates {
+			t.Rates[windows[idx]] = rate
+		}
+		res.Topics = append(res.Topics, t)
+	}
+	writeJSONResponse(w, http.StatusOK, res)
+}
+
+/* Buckets of the retention tier resolution (empty = chart_resolution), of topic or all topics summed up */
+func (d *TopicProc) series(resolution string, topic string) (string, []apiPoint, error) {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	resolution = getBetterStringNoErr(resolution, d.chart.resolution)
+	tier := d.chart.tier(resolution)
+	if tier == nil {
+		return resolution, nil, fmt.Errorf("%w: unknown resolution, use one of %s", errBadCommand, strings.Join(d.chart.resolutions(), ", "))
+	}
+
+	points := make([]apiPoint, 0, len(tier.buckets))
+	for _, b := range tier.buckets {
+		p := apiPoint{Start: b.Start, Samples: b.Samples}
+		for t, agg := range b.Messages {
+			if len(topic) == 0 || t == topic {
+				p.Messages += agg.Sum
+			}
+		}
+		for t, agg := range b.Bytes {
+			if len(topic) == 0 || t == topic {
+				p.Bytes += agg.Sum
+			}
+		}
+		points = append(points, p)
+	}
+	return resolution, points, nil
+}
+
+/* Chart history of ?topic= or of all topics summed up, ?res= picks the retention tier */
+func handleAPISeries(w http.ResponseWriter, r *http.Request) {
+	tp := apiWatch(w, r)
+	if tp == nil {
+		return
+	}
+	res := apiSeries{FriendlyName: tp.friendlyName, Topic: r.URL.Query().Get("topic")}
+
+	var err error
+	res.Resolution, res.Points, err = tp.series(r.URL.Query().Get("res"), res.Topic)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, res)
+}
+
+/*
+{name} is the friendly name, it can't contain / (see SettingsTopicEntry.validate)
+but spaces, + & # have to be escaped. Without api_token the api is read only.
+*/
+func registerAPI(mux *http.ServeMux, settings SettingsHttp) {
+	mux.HandleFunc("GET /api/watches", handleAPIWatches)
+	mux.HandleFunc("GET /api/watches/{name}", handleAPIWatch)
+	mux.HandleFunc("GET /api/watches/{name}/topics", handleAPITopics)
+	mux.HandleFunc("GET /api/watches/{name}/series", handleAPISeries)
+	mux.HandleFunc("GET /api/watches/{name}/top", handleAPITop)
+	mux.HandleFunc("GET /api/top", handleAPITop)
+
+	if len(settings.ApiToken) == 0 {
+		InfoLogger.Println("http: no api_token, the api is read only")
+		return
+	}
+	mux.HandleFunc("POST /api/watches", requireToken(settings.ApiToken, handleAPIAddWatch))
+	mux.HandleFunc("DELETE /api/watches/{name}", requireToken(settings.ApiToken, handleAPIRemoveWatch))
+	mux.HandleFunc("POST /api/watches/{name}/exclude", requireToken(settings.ApiToken, handleAPIExclude))
+	mux.HandleFunc("POST /api/watches/{name}/reset", requireToken(settings.ApiToken, handleAPICommand(CONTROL_RESET)))
+	mux.HandleFunc("POST /api/watches/{name}/snapshot", requireToken(settings.ApiToken, handleAPICommand(CONTROL_SNAPSHOT)))
+	mux.HandleFunc("POST /api/reset", requireToken(settings.ApiToken, handleAPICommand(CONTROL_RESET)))
+	mux.HandleFunc("POST /api/snapshot", requireToken(settings.ApiToken, handleAPICommand(CONTROL_SNAPSHOT)))
+}
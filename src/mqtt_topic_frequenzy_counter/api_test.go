@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+/* One watch named "From Zigbee Network" behind the supervisor the api runs its commands on */
+func setupTestAPI(t *testing.T) {
+	t.Helper()
+	sched := newTestScheduler(t)
+	fman := &fileman{working_directory: t.TempDir()}
+
+	savedProcs, savedSupervisor := topicProcs, topicSupervisor
+	t.Cleanup(func() { topicProcs, topicSupervisor = savedProcs, savedSupervisor })
+
+	settings := &SettingsStruct{}
+	tp, err := setupTopicProc(SettingsTopicEntry{FriendlyName: "From Zigbee Network", Topic: "zigbee2mqtt/#"}, settings, nil, sched, fman)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topicProcs = []*TopicProc{tp}
+	topicSupervisor = &supervisor{ctx: context.Background(), settings: settings, sched: sched, fman: fman}
+}
+
+func apiRequest(mux *http.ServeMux, method string, path string, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAPIReadOnlyWithoutToken(t *testing.T) {
+	setupTestAPI(t)
+	mux := newHttpMux(SettingsHttp{})
+
+	watch := "/api/watches/" + url.PathEscape("From Zigbee Network")
+	if code := apiRequest(mux, http.MethodGet, watch, ""); code != http.StatusOK {
+		t.Errorf("GET %s: %d", watch, code)
+	}
+	for _, path := range []string{"/api/reset", watch + "/reset"} {
+		if code := apiRequest(mux, http.MethodPost, path, ""); code < 400 {
+			t.Errorf("POST %s without api_token: %d", path, code)
+		}
+	}
+	if code := apiRequest(mux, http.MethodDelete, watch, ""); code < 400 {
+		t.Errorf("DELETE %s without api_token: %d", watch, code)
+	}
+	if findTopicProc("From Zigbee Network") == nil {
+		t.Error("the watch was removed")
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	setupTestAPI(t)
+	mux := newHttpMux(SettingsHttp{ApiToken: "secret"})
+	reset := "/api/watches/" + url.PathEscape("From Zigbee Network") + "/reset"
+
+	cases := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		if code := apiRequest(mux, http.MethodPost, reset, c.token); code != c.code {
+			t.Errorf("POST %s with token %q: %d, expected %d", reset, c.token, code, c.code)
+		}
+	}
+	if code := apiRequest(mux, http.MethodPost, "/api/watches/unknown/reset", "secret"); code != http.StatusNotFound {
+		t.Errorf("reset of an unknown watch: %d", code)
+	}
+}
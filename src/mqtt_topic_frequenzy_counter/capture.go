@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+/*
+Capture file layout, all integers are (u)varints unless noted:
+
+	header: CAPTURE_MAGIC, start time as unix nanoseconds (8 bytes big endian)
+	record: nanoseconds since the previous record (the start for the first one),
+	        flags (1 byte: bit 0-1 QoS, bit 2 retain, bit 3 payload follows),
+	        topic length, topic, payload size, [payload]
+*/
+const (
+	CAPTURE_MAGIC         = "MTFCAP1\n"
+	CAPTURE_FLAG_QOS      = 0x03
+	CAPTURE_FLAG_RETAIN   = 0x04
+	CAPTURE_FLAG_PAYLOAD  = 0x08
+	CAPTURE_FLUSH_EVERY   = time.Second
+	CAPTURE_MAX_TOPIC_LEN = 65535
+	CAPTURE_MAX_PAYLOAD   = 268435455
+)
+
+type captureRecord struct {
+	Time    time.Time
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Size    int
+	Payload []byte
+}
+
+/* The recorder, nil unless --record is given */
+var recorder *captureWriter
+
+type captureWriter struct {
+	_mutex    sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	last      time.Time
+	flushed   time.Time
+	payloads  bool
+	scratch   []byte
+	recordErr error
+}
+
+func newCaptureWriter(path string, payloads bool, start time.Time) (*captureWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &captureWriter{
+		file:     f,
+		writer:   bufio.NewWriter(f),
+		last:     start,
+		flushed:  start,
+		payloads: payloads,
+		scratch:  make([]byte, binary.MaxVarintLen64),
+	}
+	c.writer.WriteString(CAPTURE_MAGIC)
+	binary.Write(c.writer, binary.BigEndian, start.UnixNano())
+	if err = c.writer.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+/* Internal function, expects _mutex to be held */
+func (c *captureWriter) _uvarint(v uint64) {
+	n := binary.PutUvarint(c.scratch, v)
+	c.writer.Write(c.scratch[:n])
+}
+
+/* Only the first error is logged, a full disk would flood the log otherwise */
+func (c *captureWriter) write(now time.Time, p *paho.Publish) {
+	c._mutex.Lock()
+	defer c._mutex.Unlock()
+
+	// the capture has to be monotonic, a clock going backwards records a zero delta
+	delta := now.Sub(c.last)
+	if delta < 0 {
+		delta = 0
+	} else {
+		c.last = now
+	}
+
+	flags := p.QoS & CAPTURE_FLAG_QOS
+	if p.Retain {
+		flags |= CAPTURE_FLAG_RETAIN
+	}
+	if c.payloads {
+		flags |= CAPTURE_FLAG_PAYLOAD
+	}
+
+	c._uvarint(uint64(delta))
+	c.writer.WriteByte(flags)
+	c._uvarint(uint64(len(p.Topic)))
+	c.writer.WriteString(p.Topic)
+	c._uvarint(uint64(len(p.Payload)))
+	if c.payloads {
+		c.writer.Write(p.Payload)
+	}
+
+	if now.Sub(c.flushed) >= CAPTURE_FLUSH_EVERY {
+		c.flushed = now
+		if err := c.writer.Flush(); err != nil && c.recordErr == nil {
+			c.recordErr = err
+			ErrorLogger.Printf("Writing capture %s failed: %s\n", c.file.Name(), err)
+		}
+	}
+}
+
+func (c *captureWriter) Close() error {
+	c._mutex.Lock()
+	defer c._mutex.Unlock()
+
+	err := c.writer.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type captureReader struct {
+	reader *bufio.Reader
+	last   time.Time
+}
+
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	c := &captureReader{reader: bufio.NewReader(r)}
+
+	magic := make([]byte, len(CAPTURE_MAGIC))
+	if _, err := io.ReadFull(c.reader, magic); err != nil || string(magic) != CAPTURE_MAGIC {
+		return nil, errors.New("capture: not a capture file")
+	}
+	var start int64
+	if err := binary.Read(c.reader, binary.BigEndian, &start); err != nil {
+		return nil, fmt.Errorf("capture: header: %w", err)
+	}
+	c.last = time.Unix(0, start)
+	return c, nil
+}
+
+/* Time of the capture start, or of the last record read */
+func (c *captureReader) now() time.Time {
+	return c.last
+}
+
+/* io.EOF after the last record, a capture cut off mid record gives io.ErrUnexpectedEOF */
+func (c *captureReader) next() (captureRecord, error) {
+	var rec captureRecord
+
+	delta, err := binary.ReadUvarint(c.reader)
+	if err != nil {
+		return rec, err
+	}
+	flags, err := c.reader.ReadByte()
+	if err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	topicLen, err := binary.ReadUvarint(c.reader)
+	if err != nil || topicLen > CAPTURE_MAX_TOPIC_LEN {
+		return rec, io.ErrUnexpectedEOF
+	}
+	topic := make([]byte, topicLen)
+	if _, err = io.ReadFull(c.reader, topic); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	size, err := binary.ReadUvarint(c.reader)
+	if err != nil || size > CAPTURE_MAX_PAYLOAD {
+		return rec, io.ErrUnexpectedEOF
+	}
+	if flags&CAPTURE_FLAG_PAYLOAD != 0 {
+		rec.Payload = make([]byte, size)
+		if _, err = io.ReadFull(c.reader, rec.Payload); err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+	}
+
+	c.last = c.last.Add(time.Duration(delta))
+	rec.Time = c.last
+	rec.Topic = string(topic)
+	rec.QoS = flags & CAPTURE_FLAG_QOS
+	rec.Retain = flags&CAPTURE_FLAG_RETAIN != 0
+	rec.Size = int(size)
+	return rec, nil
+}
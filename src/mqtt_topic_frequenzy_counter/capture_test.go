@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func writeTestCapture(t *testing.T, payloads bool, start time.Time, times []time.Time, packets []*paho.Publish) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.cap")
+	w, err := newCaptureWriter(path, payloads, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range packets {
+		w.write(times[i], p)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readTestCapture(t *testing.T, path string) (*captureReader, []captureRecord, error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := newCaptureReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []captureRecord
+	for {
+		rec, err := r.next()
+		if err != nil {
+			return r, recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	start := testEpoch
+	times := []time.Time{
+		start.Add(1500 * time.Millisecond),
+		start.Add(2 * time.Second),
+		// a clock going backwards is recorded as no time passing
+		start.Add(time.Second),
+		start.Add(time.Hour),
+	}
+	packets := []*paho.Publish{
+		{Topic: "zigbee2mqtt/lamp", QoS: 1, Payload: []byte(`{"state":"ON"}`)},
+		{Topic: "zigbee2mqtt/lamp/set", QoS: 0, Retain: true, Payload: []byte("OFF")},
+		{Topic: "a", QoS: 2},
+		{Topic: "zigbee2mqtt/bridge/logging", QoS: 1, Payload: bytes.Repeat([]byte("x"), 300)},
+	}
+	wantTimes := []time.Time{times[0], times[1], times[1], times[3]}
+
+	for _, payloads := range []bool{false, true} {
+		path := writeTestCapture(t, payloads, start, times, packets)
+		r, recs, err := readTestCapture(t, path)
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("payloads %t: reading ended with %v instead of io.EOF", payloads, err)
+		}
+		if len(recs) != len(packets) {
+			t.Fatalf("payloads %t: %d records, expected %d", payloads, len(recs), len(packets))
+		}
+		for i, rec := range recs {
+			p := packets[i]
+			if !rec.Time.Equal(wantTimes[i]) || rec.Topic != p.Topic || rec.QoS != p.QoS || rec.Retain != p.Retain || rec.Size != len(p.Payload) {
+				t.Errorf("payloads %t: record %d is %+v, expected %s %s qos %d retain %t size %d",
+					payloads, i, rec, wantTimes[i], p.Topic, p.QoS, p.Retain, len(p.Payload))
+			}
+			if payloads && !slices.Equal(rec.Payload, p.Payload) {
+				t.Errorf("record %d has payload %q, expected %q", i, rec.Payload, p.Payload)
+			}
+			if !payloads && rec.Payload != nil {
+				t.Errorf("record %d has a payload without record-payload", i)
+			}
+		}
+		if !r.now().Equal(times[3]) {
+			t.Errorf("payloads %t: now() is %s after the last record, expected %s", payloads, r.now(), times[3])
+		}
+	}
+}
+
+func TestCaptureReaderStart(t *testing.T) {
+	path := writeTestCapture(t, false, testEpoch, nil, nil)
+	r, recs, err := readTestCapture(t, path)
+	if !errors.Is(err, io.EOF) || len(recs) != 0 {
+		t.Fatalf("empty capture gave %d records and %v", len(recs), err)
+	}
+	if !r.now().Equal(testEpoch) {
+		t.Errorf("now() is %s, expected the start %s", r.now(), testEpoch)
+	}
+}
+
+func TestCaptureTruncated(t *testing.T) {
+	path := writeTestCapture(t, true, testEpoch,
+		[]time.Time{testEpoch.Add(time.Second)},
+		[]*paho.Publish{{Topic: "zigbee2mqtt/lamp", Payload: []byte("ON")}})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cut off in the payload, in the topic & in the delta
+	for _, cut := range []int{1, 4, len(b) - len(CAPTURE_MAGIC) - 8 - 1} {
+		if err = os.WriteFile(path, b[:len(b)-cut], 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, recs, err := readTestCapture(t, path)
+		if !errors.Is(err, io.ErrUnexpectedEOF) || len(recs) != 0 {
+			t.Errorf("cut %d bytes: %d records and %v, expected io.ErrUnexpectedEOF", cut, len(recs), err)
+		}
+	}
+}
+
+func TestCaptureReaderRejects(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":     "",
+		"magic":     "MTFCAP9\n12345678",
+		"no header": CAPTURE_MAGIC + "123",
+	} {
+		if _, err := newCaptureReader(bytes.NewReader([]byte(data))); err == nil {
+			t.Errorf("%s: accepted as a capture", name)
+		}
+	}
+}
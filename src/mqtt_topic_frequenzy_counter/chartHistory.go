@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+resolution: go duration, samples within it are consolidated into one bucket
+keep: go duration, buckets older than this are dropped
+*/
+type SettingsRetention struct {
+	Resolution string `yaml:"resolution"`
+	Keep       string `yaml:"keep"`
+}
+
+var DEFAULT_RETENTION = []SettingsRetention{
+	{Resolution: "1m", Keep: "24h"},
+	{Resolution: "1h", Keep: "720h"},
+	{Resolution: "24h", Keep: "8760h"},
+}
+
+/* Consolidated values of one topic within a bucket, Count is the number of samples the topic was part of */
+type chartAggregate struct {
+	Sum   uint64 `json:"sum"`
+	Min   uint64 `json:"min"`
+	Max   uint64 `json:"max"`
+	Count uint32 `json:"count"`
+}
+
+type chartBucket struct {
+	Start    time.Time                  `json:"start"`
+	Samples  uint32                     `json:"samples"`
+	Messages map[string]*chartAggregate `json:"messages"`
+	Bytes    map[string]*chartAggregate `json:"bytes"`
+}
+
+/* All buckets of one resolution, ordered by time */
+type chartTier struct {
+	name       string
+	resolution time.Duration
+	keep       time.Duration
+	buckets    []*chartBucket
+}
+
+func newChartTiers(settings []SettingsRetention) ([]chartTier, error) {
+	if len(settings) == 0 {
+		settings = DEFAULT_RETENTION
+	}
+
+	tiers := make([]chartTier, 0, len(settings))
+	for idx, s := range settings {
+		resolution, err := time.ParseDuration(s.Resolution)
+		if err != nil {
+			return nil, fmt.Errorf("retention[%d]: resolution: %w", idx, err)
+		}
+		keep, err := time.ParseDuration(s.Keep)
+		if err != nil {
+			return nil, fmt.Errorf("retention[%d]: keep: %w", idx, err)
+		}
+		if resolution <= 0 || keep < resolution {
+			return nil, fmt.Errorf("retention[%d]: keep has to be at least one resolution", idx)
+		}
+		if idx > 0 && resolution <= tiers[idx-1].resolution {
+			return nil, fmt.Errorf("retention[%d]: resolutions have to get coarser", idx)
+		}
+		tiers = append(tiers, chartTier{name: s.Resolution, resolution: resolution, keep: keep})
+	}
+	return tiers, nil
+}
+
+func (a *chartAggregate) add(val uint64) {
+	if a.Count == 0 || val < a.Min {
+		a.Min = val
+	}
+	if val > a.Max {
+		a.Max = val
+	}
+	a.Sum += val
+	a.Count++
+}
+
+func (t *chartTier) push(at time.Time, msgs map[string]uint32, bytes map[string]uint64) {
+	start := at.Truncate(t.resolution)
+
+	var bucket *chartBucket
+	// a clock going backwards must not break the order, it ends up in the newest bucket
+	if n := len(t.buckets); n > 0 && !start.After(t.buckets[n-1].Start) {
+		bucket = t.buckets[n-1]
+	} else {
+		bucket = &chartBucket{
+			Start:    start,
+			Messages: make(map[string]*chartAggregate),
+			Bytes:    make(map[string]*chartAggregate),
+		}
+		t.buckets = append(t.buckets, bucket)
+	}
+
+	bucket.Samples++
+	for topic, val := range msgs {
+		if bucket.Messages[topic] == nil {
+			bucket.Messages[topic] = new(chartAggregate)
+		}
+		bucket.Messages[topic].add(uint64(val))
+	}
+	for topic, val := range bytes {
+		if bucket.Bytes[topic] == nil {
+			bucket.Bytes[topic] = new(chartAggregate)
+		}
+		bucket.Bytes[topic].add(val)
+	}
+	// samples in which a topic was missing count as zero
+	for _, aggs := range []map[string]*chartAggregate{bucket.Messages, bucket.Bytes} {
+		for _, agg := range aggs {
+			if agg.Count < bucket.Samples {
+				agg.Min = 0
+			}
+		}
+	}
+
+	t.prune(at)
+}
+
+func (t *chartTier) prune(now time.Time) {
+	oldest := now.Add(-t.keep)
+	drop := 0
+	for drop < len(t.buckets) && t.buckets[drop].Start.Before(oldest) {
+		drop++
+	}
+	if drop > 0 {
+		t.buckets = append([]*chartBucket(nil), t.buckets[drop:]...)
+	}
+}
+
+/* Every topic found in the tier */
+func (t *chartTier) topics() []string {
+	unique := UniqueStringArray{array: make(map[string]bool)}
+	for _, b := range t.buckets {
+		topics, _ := MapKeys(b.Messages)
+		unique.AddStrings(topics...)
+	}
+	topics, _ := unique.getStrings()
+	return topics
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewChartTiers(t *testing.T) {
+	tiers, err := newChartTiers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiers) != len(DEFAULT_RETENTION) || tiers[0].resolution != time.Minute || tiers[0].keep != 24*time.Hour {
+		t.Errorf("default tiers: %+v", tiers)
+	}
+
+	for _, settings := range [][]SettingsRetention{
+		{{Resolution: "nope", Keep: "1h"}},
+		{{Resolution: "1m", Keep: "nope"}},
+		{{Resolution: "1h", Keep: "1m"}},
+		{{Resolution: "0s", Keep: "1m"}},
+		{{Resolution: "1h", Keep: "24h"}, {Resolution: "1m", Keep: "48h"}},
+	} {
+		if _, err := newChartTiers(settings); err == nil {
+			t.Errorf("newChartTiers(%+v) accepted invalid settings", settings)
+		}
+	}
+}
+
+func TestChartTierAggregates(t *testing.T) {
+	tier := chartTier{name: "1h", resolution: time.Hour, keep: 24 * time.Hour}
+	tier.push(testEpoch, map[string]uint32{"a": 4, "b": 1}, map[string]uint64{"a": 40})
+	tier.push(testEpoch.Add(10*time.Minute), map[string]uint32{"a": 2}, map[string]uint64{"a": 20})
+	tier.push(testEpoch.Add(20*time.Minute), map[string]uint32{"a": 6}, map[string]uint64{"a": 60})
+
+	if len(tier.buckets) != 1 {
+		t.Fatalf("%d buckets, expected every sample in one", len(tier.buckets))
+	}
+	b := tier.buckets[0]
+	if b.Samples != 3 || !b.Start.Equal(testEpoch) {
+		t.Errorf("bucket %s with %d samples", b.Start, b.Samples)
+	}
+	if a := *b.Messages["a"]; a != (chartAggregate{Sum: 12, Min: 2, Max: 6, Count: 3}) {
+		t.Errorf("a: %+v", a)
+	}
+	if a := *b.Bytes["a"]; a != (chartAggregate{Sum: 120, Min: 20, Max: 60, Count: 3}) {
+		t.Errorf("a bytes: %+v", a)
+	}
+	// b only published in one of three samples, the others count as zero
+	if a := *b.Messages["b"]; a != (chartAggregate{Sum: 1, Min: 0, Max: 1, Count: 1}) {
+		t.Errorf("b: %+v", a)
+	}
+
+	tier.push(testEpoch.Add(time.Hour+time.Minute), map[string]uint32{"c": 1}, nil)
+	if len(tier.buckets) != 2 || !tier.buckets[1].Start.Equal(testEpoch.Add(time.Hour)) {
+		t.Fatalf("a new hour didn't start a new bucket: %d buckets", len(tier.buckets))
+	}
+	if topics := tier.topics(); !slices.Equal(sortedStrings(topics), []string{"a", "b", "c"}) {
+		t.Errorf("topics %v", topics)
+	}
+	if busiest := tier.busiestTopics(); !slices.Equal(busiest, []string{"a", "b", "c"}) {
+		t.Errorf("busiestTopics %v", busiest)
+	}
+
+	// a clock going backwards ends up in the newest bucket
+	tier.push(testEpoch.Add(5*time.Minute), map[string]uint32{"c": 1}, nil)
+	if len(tier.buckets) != 2 || tier.buckets[1].Messages["c"].Sum != 2 {
+		t.Errorf("going back in time changed the order or lost the sample")
+	}
+}
+
+func TestChartTierPrune(t *testing.T) {
+	tier := chartTier{name: "1m", resolution: time.Minute, keep: 10 * time.Minute}
+	for idx := 0; idx < 30; idx++ {
+		tier.push(testEpoch.Add(time.Duration(idx)*time.Minute), map[string]uint32{"a": 1}, nil)
+	}
+	if len(tier.buckets) != 11 {
+		t.Errorf("%d buckets left, keep 10m of 1m buckets expected 11", len(tier.buckets))
+	}
+	if oldest := tier.buckets[0].Start; oldest.Before(testEpoch.Add(19 * time.Minute)) {
+		t.Errorf("oldest bucket %s is older than keep", oldest)
+	}
+}
+
+/* Every sample goes into every tier */
+func TestChartDataHolderTiers(t *testing.T) {
+	d, err := newChartDataHolder(SettingsTopicEntry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 120; idx++ {
+		d.pushAt(testEpoch.Add(time.Duration(idx)*time.Minute), map[string]uint32{"a": 1}, nil)
+	}
+	for resolution, want := range map[string]int{"1m": 120, "1h": 2, "24h": 1} {
+		if got := len(d.tier(resolution).buckets); got != want {
+			t.Errorf("%s: %d buckets, expected %d", resolution, got, want)
+		}
+	}
+	if sum := d.tier("24h").buckets[0].Messages["a"].Sum; sum != 120 {
+		t.Errorf("24h sum %d, expected 120", sum)
+	}
+	if d.tier("5m") != nil {
+		t.Error("found a tier that isn't configured")
+	}
+
+	if _, err := newChartDataHolder(SettingsTopicEntry{ChartResolution: "5m"}); err == nil {
+		t.Error("accepted a chart_resolution without a tier")
+	}
+	if _, err := newChartDataHolder(SettingsTopicEntry{ChartTypes: []string{"pie"}}); err == nil {
+		t.Error("accepted an unknown chart type")
+	}
+}
+
+func sortedStrings(s []string) []string {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"io"
-	"maps"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-echarts/go-echarts/v2/charts"
@@ -10,44 +13,169 @@ import (
 	"github.com/go-echarts/go-echarts/v2/opts"
 )
 
-type ChartTimeData struct {
-	content map[string]uint32
-}
+const (
+	CHART_TYPE_BAR      = "bar"
+	CHART_TYPE_HEATMAP  = "heatmap"
+	CHART_TYPE_LINE     = "line"
+	DEFAULT_CHART_TOP_N = 20
+)
+
+var DEFAULT_CHART_TYPES = []string{CHART_TYPE_BAR, CHART_TYPE_HEATMAP, CHART_TYPE_LINE}
 
+/*
+Chart history in retention tiers (see chartHistory.go), finest first.
+Every sample is consolidated into all tiers, so memory is bounded by keep/resolution.
+resolution is the tier rendered when nothing else is asked for.
+types are the charts on the rendered page in order, bar & line only show the topN busiest topics.
+*/
 type ChartDataHolder struct {
-	timedData map[time.Time]ChartTimeData
-	topics    UniqueStringArray
+	tiers      []chartTier
+	resolution string
+	types      []string
+	topN       int
 }
 
-func (d *ChartDataHolder) ChartPushData(data map[string]uint32) {
-	d.timedData[time.Now()] = ChartTimeData{content: maps.Clone(data)}
-	topics, _ := MapKeys(data)
-	d.topics.AddStrings(topics...)
+func newChartDataHolder(setting SettingsTopicEntry) (ChartDataHolder, error) {
+	tiers, err := newChartTiers(setting.Retention)
+	if err != nil {
+		return ChartDataHolder{}, err
+	}
+	d := ChartDataHolder{
+		tiers:      tiers,
+		resolution: getBetterStringNoErr(setting.ChartResolution, tiers[0].name),
+		types:      DEFAULT_CHART_TYPES,
+		topN:       DEFAULT_CHART_TOP_N,
+	}
+	if d.tier(d.resolution) == nil {
+		return d, fmt.Errorf("chart_resolution: %s is not one of the retention resolutions", setting.ChartResolution)
+	}
+	if len(setting.ChartTypes) > 0 {
+		d.types = setting.ChartTypes
+	}
+	for _, chartType := range d.types {
+		if !slices.Contains(DEFAULT_CHART_TYPES, chartType) {
+			return d, fmt.Errorf("chart_types: unknown type %q, use %s", chartType, strings.Join(DEFAULT_CHART_TYPES, ", "))
+		}
+	}
+	if setting.ChartTopN < 0 {
+		return d, fmt.Errorf("chart_top_n: has to be positive")
+	}
+	if setting.ChartTopN > 0 {
+		d.topN = setting.ChartTopN
+	}
+	return d, nil
 }
 
-func (d *ChartDataHolder) toLineItems(topic string, times *[]time.Time) []opts.LineData {
-	ld := make([]opts.LineData, 0)
-	for _, t := range *times {
-		val, found := d.timedData[t].content[topic]
-		if found {
-			ldd := opts.LineData{Value: val}
-			ld = append(ld, ldd)
+/* nil if there is no tier with that resolution */
+func (d *ChartDataHolder) tier(resolution string) *chartTier {
+	for idx := range d.tiers {
+		if d.tiers[idx].name == resolution {
+			return &d.tiers[idx]
 		}
 	}
-	return ld
+	return nil
 }
 
-func (d *ChartDataHolder) GenChart(writer io.Writer, title string, subtitle string) error {
-	page := components.NewPage()
-	page.Layout = components.PageFlexLayout
-	page.Width = "100%"
-	page.Height = "100%"
+func (d *ChartDataHolder) resolutions() []string {
+	names := make([]string, 0, len(d.tiers))
+	for _, t := range d.tiers {
+		names = append(names, t.name)
+	}
+	return names
+}
 
-	times, _ := MapKeys(d.timedData)
-	topics, _ := d.topics.getStrings()
+func (d *ChartDataHolder) ChartPushData(data map[string]uint32, bytes map[string]uint64) {
+	d.pushAt(clock.Now(), data, bytes)
+}
 
-	line := charts.NewLine()
+func (d *ChartDataHolder) pushAt(at time.Time, data map[string]uint32, bytes map[string]uint64) {
+	for idx := range d.tiers {
+		d.tiers[idx].push(at, data, bytes)
+	}
+}
+
+func (d *ChartDataHolder) toState() []chartTierState {
+	states := make([]chartTierState, 0, len(d.tiers))
+	for _, t := range d.tiers {
+		states = append(states, chartTierState{Resolution: t.name, Buckets: t.buckets})
+	}
+	return states
+}
+
+/* Tiers that are no longer configured are dropped, new ones start empty */
+func (d *ChartDataHolder) fromState(states []chartTierState, now time.Time) {
+	for _, s := range states {
+		if t := d.tier(s.Resolution); t != nil {
+			t.buckets = s.Buckets
+			t.prune(now)
+		}
+	}
+}
+
+/*
+The usual distance between buckets: the resolution, or the sampling interval
+if samples are rarer (e.g. sample_chart every 5m into the 1m tier).
+The (lower) median, so a few gaps don't make it longer.
+*/
+func (t *chartTier) step() time.Duration {
+	if len(t.buckets) < 2 {
+		return t.resolution
+	}
+	distances := make([]time.Duration, 0, len(t.buckets)-1)
+	for idx := 1; idx < len(t.buckets); idx++ {
+		distances = append(distances, t.buckets[idx].Start.Sub(t.buckets[idx-1].Start))
+	}
+	slices.Sort(distances)
+	return max(t.resolution, distances[(len(distances)-1)/2])
+}
+
+/*
+One [time, value] point per bucket, ordered by time.
+A topic missing in a bucket did not publish, so it is an explicit zero.
+Missing samples (e.g. downtime) get a null point, which breaks the line instead of bridging the gap.
+*/
+func (t *chartTier) toSeries(topic string, bytes bool) []opts.LineData {
+	step := t.step()
+	ld := make([]opts.LineData, 0, len(t.buckets))
+	for idx, b := range t.buckets {
+		// more than half a step late means at least one sample is missing
+		if idx > 0 && b.Start.Sub(t.buckets[idx-1].Start) > step+step/2 {
+			gap := t.buckets[idx-1].Start.Add(step)
+			ld = append(ld, opts.LineData{Value: []interface{}{gap.UnixMilli(), nil}})
+		}
 
+		aggs := b.Messages
+		if bytes {
+			aggs = b.Bytes
+		}
+		var val uint64
+		if agg, found := aggs[topic]; found {
+			val = agg.Sum
+		}
+		ld = append(ld, opts.LineData{Value: []interface{}{b.Start.UnixMilli(), val}})
+	}
+	return ld
+}
+
+/* Topics of the tier with the most messages first */
+func (t *chartTier) busiestTopics() []string {
+	sums := make(map[string]uint64)
+	for _, b := range t.buckets {
+		for topic, agg := range b.Messages {
+			sums[topic] += agg.Sum
+		}
+	}
+	topics := t.topics()
+	sort.SliceStable(topics, func(i, j int) bool {
+		if sums[topics[i]] != sums[topics[j]] {
+			return sums[topics[i]] > sums[topics[j]]
+		}
+		return topics[i] < topics[j]
+	})
+	return topics
+}
+
+func chartToolbox() opts.Toolbox {
 	toolbox := opts.Toolbox{Show: true}
 	toolbox.Feature = new(opts.ToolBoxFeature)
 	toolbox.Feature.SaveAsImage = new(opts.ToolBoxFeatureSaveAsImage)
@@ -58,30 +186,142 @@ func (d *ChartDataHolder) GenChart(writer io.Writer, title string, subtitle stri
 	toolbox.Feature.DataView.Show = true
 	toolbox.Feature.Restore = new(opts.ToolBoxFeatureRestore)
 	toolbox.Feature.Restore.Show = true
+	return toolbox
+}
+
+/* The topN busiest topics of the current window */
+func (d *ChartDataHolder) genBarChart(title string, current map[string]uint32) *charts.Bar {
+	topics, _ := MapKeys(current)
+	sort.SliceStable(topics, func(i, j int) bool {
+		if current[topics[i]] != current[topics[j]] {
+			return current[topics[i]] > current[topics[j]]
+		}
+		return topics[i] < topics[j]
+	})
+	if len(topics) > d.topN {
+		topics = topics[:d.topN]
+	}
 
+	items := make([]opts.BarData, 0, len(topics))
+	for _, topic := range topics {
+		items = append(items, opts.BarData{Value: current[topic]})
+	}
+
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: "dark", Width: "100%", Height: "500px"}),
+		charts.WithTitleOpts(opts.Title{Title: title, Subtitle: fmt.Sprintf("top %d of the current window", d.topN)}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+		charts.WithToolboxOpts(chartToolbox()),
+		charts.WithXAxisOpts(opts.XAxis{AxisLabel: &opts.AxisLabel{Rotate: 30, Interval: "0"}}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "messages"}),
+		charts.WithGridOpts(opts.Grid{Bottom: "30%"}),
+	)
+	bar.SetXAxis(topics).AddSeries("messages", items)
+	return bar
+}
+
+/* Every topic of the tier against time, busiest on top */
+func (d *ChartDataHolder) genHeatMap(title string, tier *chartTier) *charts.HeatMap {
+	topics := tier.busiestTopics()
+	// the category axis counts from the bottom
+	slices.Reverse(topics)
+	row := make(map[string]int, len(topics))
+	for idx, topic := range topics {
+		row[topic] = idx
+	}
+
+	times := make([]string, 0, len(tier.buckets))
+	items := make([]opts.HeatMapData, 0)
+	var highest uint64
+	for col, b := range tier.buckets {
+		times = append(times, b.Start.Format(time.DateTime))
+		for topic, agg := range b.Messages {
+			items = append(items, opts.HeatMapData{Value: [3]interface{}{col, row[topic], agg.Sum}})
+			highest = max(highest, agg.Sum)
+		}
+	}
+
+	hm := charts.NewHeatMap()
+	hm.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: "dark", Width: "100%", Height: fmt.Sprintf("%dpx", 200+16*len(topics))}),
+		charts.WithTitleOpts(opts.Title{Title: title, Subtitle: fmt.Sprintf("messages per %s", tier.name)}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true}),
+		charts.WithToolboxOpts(chartToolbox()),
+		charts.WithDataZoomOpts(opts.DataZoom{Type: "inside", XAxisIndex: []int{0}}),
+		charts.WithYAxisOpts(opts.YAxis{Type: "category", Data: topics, SplitArea: &opts.SplitArea{Show: true}}),
+		charts.WithGridOpts(opts.Grid{Left: "20%"}),
+		charts.WithVisualMapOpts(opts.VisualMap{
+			Calculable: true,
+			Min:        0,
+			Max:        float32(max(highest, 1)),
+			Orient:     "horizontal",
+			Left:       "center",
+			InRange:    &opts.VisualMapInRange{Color: []string{"#313695", "#4575b4", "#fee090", "#f46d43", "#a50026"}},
+		}),
+	)
+	hm.SetXAxis(times).AddSeries("messages", items)
+	return hm
+}
+
+/* The topN busiest topics of the tier over time */
+func (d *ChartDataHolder) genLineChart(title string, subtitle string, tier *chartTier) *charts.Line {
+	topics := tier.busiestTopics()
+	if len(topics) > d.topN {
+		topics = topics[:d.topN]
+	}
+
+	line := charts.NewLine()
 	line.SetGlobalOptions(
-		charts.WithInitializationOpts(opts.Initialization{Theme: "dark", PageTitle: "mqtt_topics", Width: "100%", Height: "100vh"}),
+		charts.WithInitializationOpts(opts.Initialization{Theme: "dark", Width: "100%", Height: "100vh"}),
 		charts.WithTitleOpts(opts.Title{
 			Title:    title,
-			Subtitle: subtitle,
+			Subtitle: fmt.Sprintf("%s, top %d per %s", subtitle, d.topN, tier.name),
 		}),
 		charts.WithLegendOpts(opts.Legend{Type: "scroll"}),
 		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis", TriggerOn: "mousemove"}),
 		charts.WithAnimation(),
 		charts.WithDataZoomOpts(opts.DataZoom{Type: "inside"}),
-		charts.WithToolboxOpts(toolbox),
+		charts.WithToolboxOpts(chartToolbox()),
+		charts.WithXAxisOpts(opts.XAxis{Type: "time"}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "messages"}),
 	)
-
-	line.SetXAxis(times) //.
-	//AddSeries("Category A", generateLineItems()).
-	//AddSeries("Category B", generateLineItems()).
+	line.ExtendYAxis(opts.YAxis{Name: "bytes"})
 
 	for _, topic := range topics {
-		line.AddSeries(topic, d.toLineItems(topic, &times))
+		line.AddSeries(topic, tier.toSeries(topic, false), charts.WithLineChartOpts(opts.LineChart{Smooth: true}))
+		line.AddSeries(topic+" (bytes)", tier.toSeries(topic, true), charts.WithLineChartOpts(opts.LineChart{Smooth: true, YAxisIndex: 1}))
 	}
+	return line
+}
 
-	line.SetSeriesOptions(charts.WithLineChartOpts(opts.LineChart{Smooth: true}))
-	//page.AddCharts(line)
-	//return page.Render(writer)
-	return line.Render(writer)
+/*
+Renders a page with the configured chart types, history from the tier with the given resolution
+(empty means chart_resolution). current is the current window for the bar chart.
+*/
+func (d *ChartDataHolder) GenChart(writer io.Writer, title string, subtitle string, resolution string, current map[string]uint32) error {
+	resolution = getBetterStringNoErr(resolution, d.resolution)
+	tier := d.tier(resolution)
+	if tier == nil {
+		return fmt.Errorf("no chart history with resolution %s", resolution)
+	}
+
+	page := components.NewPage()
+	page.Layout = components.PageFlexLayout
+	page.PageTitle = "mqtt_topics"
+	page.Theme = "dark"
+	page.Width = "100%"
+	page.Height = "100%"
+
+	for _, chartType := range d.types {
+		switch chartType {
+		case CHART_TYPE_BAR:
+			page.AddCharts(d.genBarChart(title, current))
+		case CHART_TYPE_HEATMAP:
+			page.AddCharts(d.genHeatMap(title, tier))
+		case CHART_TYPE_LINE:
+			page.AddCharts(d.genLineChart(title, subtitle, tier))
+		}
+	}
+	return page.Render(writer)
 }
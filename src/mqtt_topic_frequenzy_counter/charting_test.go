@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+/* Compares got with testdata/name, -update writes it instead */
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s (go test -update writes it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n%s\nexpected:\n%s", path, got, want)
+	}
+}
+
+/* Every sample pushes a & b, b only in the samples listed in withB */
+type seriesScenario struct {
+	name       string
+	resolution time.Duration
+	every      time.Duration
+	samples    int
+	missing    []int
+	withB      []int
+}
+
+func (s seriesScenario) tier() *chartTier {
+	tier := &chartTier{name: s.resolution.String(), resolution: s.resolution, keep: 24 * time.Hour}
+	skip := make(map[int]bool)
+	for _, idx := range s.missing {
+		skip[idx] = true
+	}
+	b := make(map[int]bool)
+	for _, idx := range s.withB {
+		b[idx] = true
+	}
+
+	for idx := 0; idx < s.samples; idx++ {
+		if skip[idx] {
+			continue
+		}
+		msgs := map[string]uint32{"a": uint32(idx + 1)}
+		sizes := map[string]uint64{"a": uint64(10 * (idx + 1))}
+		if b[idx] {
+			msgs["b"] = 2
+			sizes["b"] = 200
+		}
+		tier.push(testEpoch.Add(time.Duration(idx)*s.every), msgs, sizes)
+	}
+	return tier
+}
+
+func TestToSeriesGolden(t *testing.T) {
+	scenarios := []seriesScenario{
+		// b is missing in most buckets, those are explicit zeros, not gaps
+		{name: "every_minute", resolution: time.Minute, every: time.Minute, samples: 5, withB: []int{1, 3}},
+		// sample_chart every 5m into the 1m tier, a continuous line
+		{name: "five_minute_samples", resolution: time.Minute, every: 5 * time.Minute, samples: 6},
+		// downtime of 10 minutes breaks the line once
+		{name: "downtime", resolution: time.Minute, every: time.Minute, samples: 16, missing: []int{5, 6, 7, 8, 9, 10, 11, 12, 13, 14}},
+		// a single missed 5m sample is a gap as well
+		{name: "five_minute_samples_missed", resolution: time.Minute, every: 5 * time.Minute, samples: 6, missing: []int{3}},
+		// several samples per bucket are summed up, an hour without samples is a gap
+		{name: "hourly_tier", resolution: time.Hour, every: 20 * time.Minute, samples: 12, missing: []int{6, 7, 8}, withB: []int{0}},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			tier := s.tier()
+			series := map[string]any{
+				"a":         tier.toSeries("a", false),
+				"a (bytes)": tier.toSeries("a", true),
+				"b":         tier.toSeries("b", false),
+			}
+			got, err := json.MarshalIndent(series, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, "series_"+s.name+".json", append(got, '\n'))
+		})
+	}
+}
+
+func TestChartTierStep(t *testing.T) {
+	cases := []struct {
+		s    seriesScenario
+		want time.Duration
+	}{
+		{seriesScenario{resolution: time.Minute, every: time.Minute, samples: 1}, time.Minute},
+		{seriesScenario{resolution: time.Minute, every: 30 * time.Second, samples: 10}, time.Minute},
+		{seriesScenario{resolution: time.Minute, every: 5 * time.Minute, samples: 10, missing: []int{2, 3, 6}}, 5 * time.Minute},
+		{seriesScenario{resolution: time.Hour, every: time.Minute, samples: 300}, time.Hour},
+	}
+	for _, c := range cases {
+		if got := c.s.tier().step(); got != c.want {
+			t.Errorf("%+v: step %s, expected %s", c.s, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "github.com/jonboulle/clockwork"
+
+/*
+Every timestamp of the stats pipeline comes from here instead of time.Now,
+replay swaps it for a fake clock that follows the capture (the scheduler shares it).
+*/
+var clock clockwork.Clock = clockwork.NewRealClock()
@@ -1,131 +1,258 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
-	"strconv"
+	"strings"
 )
 
-type ArgsToExit struct {
-	msg string
-}
+const (
+	COMMAND_RUN             = "run"
+	COMMAND_REPLAY          = "replay"
+	COMMAND_VALIDATE        = "validate"
+	COMMAND_VALIDATE_CONFIG = "validate-config"
+	COMMAND_REPORT          = "report"
+	COMMAND_DIFF            = "diff"
+	COMMAND_TOP             = "top"
+)
+
+/* Environment variables the flags fall back to */
+const (
+	ENV_CONFIG   = "MQTT_FREQ_CONFIG"
+	ENV_CWD      = "MQTT_FREQ_CWD"
+	ENV_URL      = "MQTT_FREQ_URL"
+	ENV_USER     = "MQTT_FREQ_USER"
+	ENV_PASSWORD = "MQTT_FREQ_PASSWORD"
+)
 
-func (e ArgsToExit) Error() string {
-	return "Requesting exit due to spicific arguments found"
+var commandHelp = []struct{ name, help string }{
+	{COMMAND_RUN, "count topics (default when no command is given)"},
+	{COMMAND_REPLAY, "feed a capture written with --record through the stats, no broker needed"},
+	{COMMAND_VALIDATE, "check the settings file, exits 1 if it is invalid (alias " + COMMAND_VALIDATE_CONFIG + ")"},
+	{COMMAND_REPORT, "summarize the json snapshots of the path directory"},
+	{COMMAND_DIFF, "compare the topic rates of two snapshots or time ranges"},
+	{COMMAND_TOP, "live table of the topics, connects like run but writes nothing"},
 }
 
 type ParsedArgs struct {
-	resetEveryMinutes int
-	printEverySeconds int
-	username          string
-	password          string
-	mqttUrl           string
-	settings          string
-	path              string
-
-	topic  string
-	topic2 string
-	graph  int
-	repr   bool
+	command  string
+	rest     []string
+	username string
+	password string
+	mqttUrl  string
+	settings string
+	path     string
+
+	/* --topic entries get their own TopicProc, no config file needed */
+	topics       []string
+	resetMinutes int
+	printSeconds int
+	graphMinutes int
+	graph        bool
+	repr         bool
+
+	record        string
+	recordPayload bool
+	replay        string
+	speed         float64
+}
+
+type repeatedString struct {
+	values *[]string
+}
+
+func (r repeatedString) String() string {
+	if r.values == nil {
+		return ""
+	}
+	return strings.Join(*r.values, ", ")
+}
+
+func (r repeatedString) Set(s string) error {
+	*r.values = append(*r.values, s)
+	return nil
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commandHelp {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.help)
+	}
 }
 
-func checkCmdArgs() (ParsedArgs, error) {
-	retArgs := ParsedArgs{
-		resetEveryMinutes: 60,
-		printEverySeconds: 60,
-		username:          "",
-		password:          "",
-		mqttUrl:           "",
-		topic:             "",
-		topic2:            "",
-		settings:          "",
-		path:              "",
-	}
-
-	cmdArgs := os.Args[1:]
-	length := len(cmdArgs)
-
-	for cmdOffset := 0; cmdOffset < length; cmdOffset++ {
-		cmdArg := cmdArgs[cmdOffset]
-
-		switch cmdArg {
-
-		case "--help":
-			{
-				fmt.Println(" ==== HELP =====")
-				fmt.Println("--reset Minutes to Reset all counts")
-				fmt.Println("--print Seconds between Stats Printout")
-				fmt.Println("--url MQTT Host URL (no username password)")
-				fmt.Println("--user MQTT User")
-				fmt.Println("--passwd MQTT Password")
-				fmt.Println("--topic Topic")
-				fmt.Println("--topic2 Topic")
-				fmt.Println("--repr Do print and reset immidiatly")
-				fmt.Println("--graph Generate graphs,  datapoints are collected on reset or an SIGUSR1")
-				fmt.Println("--grm Render graph every x Minutes")
-				fmt.Println("--config PATH Use custom config Path")
-				fmt.Println("--cwd Change Path, where the chart and stat files are getting stored.")
-				fmt.Println(" ==== END =====")
-				return retArgs, &ArgsToExit{msg: "help"}
-			}
-		case "--reset":
-			{
-				reset, err := strconv.Atoi(cmdArgs[cmdOffset+1])
-				if err != nil {
-					fmt.Printf("Can't convert %s to an int!", cmdArgs[cmdOffset+1])
-					cmdOffset++
-					continue
-				}
-				retArgs.resetEveryMinutes = reset
-				cmdOffset++
-			}
-		case "--print":
-			{
-				reset, err := strconv.Atoi(cmdArgs[cmdOffset+1])
-				if err != nil {
-					fmt.Printf("Can't convert %s to an int!", cmdArgs[cmdOffset+1])
-					cmdOffset++
-					continue
-				}
-				retArgs.printEverySeconds = reset
-				cmdOffset++
-			}
-		case "--url":
-			retArgs.mqttUrl = cmdArgs[cmdOffset+1]
-			cmdOffset++
-		case "--user":
-			retArgs.username = cmdArgs[cmdOffset+1]
-			cmdOffset++
-		case "--passwd":
-			retArgs.password = cmdArgs[cmdOffset+1]
-			cmdOffset++
-		case "--topic":
-			retArgs.topic = cmdArgs[cmdOffset+1]
-			cmdOffset++
-		case "--topic2":
-			retArgs.topic2 = cmdArgs[cmdOffset+1]
-			cmdOffset++
-		case "--repr":
-			retArgs.repr = true
-		case "--graph":
-			if retArgs.graph == 0 {
-				retArgs.graph = -1
-			}
-		case "--grm":
-			i, e := strconv.Atoi(cmdArgs[cmdOffset+1])
-			if e == nil {
-				retArgs.graph = i
-				cmdOffset++
-			} else {
-				fmt.Println("--grm argument is invalid")
-				fmt.Println(e)
-			}
-		case "--config":
-			retArgs.settings = cmdArgs[cmdOffset+1]
-		case "--cwd":
-			retArgs.path = cmdArgs[cmdOffset+1]
+/* Flags of run & replay, replay has no broker so it gets --speed instead of the connection flags */
+func newRunFlagSet(command string, args *ParsedArgs) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+
+	fs.StringVar(&args.settings, "config", os.Getenv(ENV_CONFIG), "settings file (default "+ETC_SETTINGS_PATH+", env "+ENV_CONFIG+")")
+	if command == COMMAND_REPLAY {
+		fs.StringVar(&args.path, "cwd", "", "where chart, json & state files of the replay are stored (default CAPTURE"+REPLAY_DIR_SUFFIX+"), never the path of the settings")
+	} else {
+		fs.StringVar(&args.path, "cwd", os.Getenv(ENV_CWD), "where chart, json & state files are stored, overrides path of the settings (env "+ENV_CWD+")")
+	}
+	fs.Var(repeatedString{&args.topics}, "topic", "watch this topic filter without a config file, can be repeated")
+	fs.Var(repeatedString{&args.topics}, "topic2", "same as --topic, kept for old command lines")
+	fs.IntVar(&args.resetMinutes, "reset", 0, "--topic entries: minutes between resets of the counters, divisors of an hour or a day, 0 = never")
+	fs.IntVar(&args.printSeconds, "print", 60, "--topic entries: seconds between stats printouts, divisors of a minute or whole minutes, 0 = never")
+	fs.IntVar(&args.graphMinutes, "grm", 0, "--topic entries: minutes between rendered graphs, same values as --reset, implies --graph")
+	fs.BoolVar(&args.graph, "graph", false, "SIGUSR1 writes json, stats & graph of every entry")
+	fs.BoolVar(&args.repr, "repr", false, "--topic entries: print the stats to the console & reset at every --print instead of writing json")
+
+	if command == COMMAND_REPLAY {
+		fs.Float64Var(&args.speed, "speed", 1, "1 = real time, 60 = a minute per second, 0 = as fast as possible")
+	} else {
+		fs.StringVar(&args.mqttUrl, "url", os.Getenv(ENV_URL), "MQTT broker url, overrides url of the settings (env "+ENV_URL+")")
+		fs.StringVar(&args.username, "user", os.Getenv(ENV_USER), "MQTT user (env "+ENV_USER+")")
+		fs.StringVar(&args.password, "passwd", os.Getenv(ENV_PASSWORD), "MQTT password (env "+ENV_PASSWORD+")")
+		fs.StringVar(&args.record, "record", "", "write every received message to this capture file")
+		fs.BoolVar(&args.recordPayload, "record-payload", false, "include the payloads in the capture")
+	}
+
+	fs.Usage = func() {
+		if command == COMMAND_REPLAY {
+			fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] CAPTURE\n\n", os.Args[0])
+		} else {
+			fmt.Fprintf(fs.Output(), "Usage: %s [command] [flags]\n\n", os.Args[0])
+			printCommands(fs.Output())
+			fmt.Fprintf(fs.Output(), "\nFlags of %s, the other commands have their own -help:\n", command)
 		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func (args *ParsedArgs) validate() error {
+	if args.resetMinutes < 0 || args.printSeconds < 0 || args.graphMinutes < 0 {
+		return errors.New("--reset, --print & --grm can't be negative")
+	}
+	if _, err := minutesCron(args.resetMinutes); err != nil {
+		return fmt.Errorf("--reset: %w", err)
+	}
+	if _, err := secondsCron(args.printSeconds); err != nil {
+		return fmt.Errorf("--print: %w", err)
+	}
+	if _, err := minutesCron(args.graphMinutes); err != nil {
+		return fmt.Errorf("--grm: %w", err)
+	}
+	if args.repr && args.printSeconds == 0 {
+		return errors.New("--repr prints at every --print, it can't be 0")
+	}
+	if args.repr && args.resetMinutes > 0 {
+		return errors.New("--repr resets at every --print, drop --reset")
+	}
+	if args.speed < 0 {
+		return errors.New("--speed can't be negative")
+	}
+	for _, topic := range args.topics {
+		if err := validateTopicFilter(topic); err != nil {
+			return fmt.Errorf("--topic: %w", err)
+		}
+	}
+	return nil
+}
+
+/* Cron for every n minutes, cron can't do uneven steps so only divisors of an hour or whole hours dividing a day work */
+func minutesCron(n int) (string, error) {
+	switch {
+	case n == 0:
+		return "", nil
+	case n < 60 && 60%n == 0:
+		return fmt.Sprintf("0 */%d * * * *", n), nil
+	case n <= 1440 && n%60 == 0 && 24%(n/60) == 0:
+		return fmt.Sprintf("0 0 */%d * * *", n/60), nil
+	}
+	return "", fmt.Errorf("%d minutes don't divide an hour or a day", n)
+}
+
+func secondsCron(n int) (string, error) {
+	switch {
+	case n == 0:
+		return "", nil
+	case n < 60 && 60%n == 0:
+		return fmt.Sprintf("*/%d * * * * *", n), nil
+	case n%60 == 0:
+		return minutesCron(n / 60)
+	}
+	return "", fmt.Errorf("%d seconds don't divide a minute", n)
+}
+
+/* Topic filters are no file names, / + # are replaced */
+func topicFriendlyName(topic string) string {
+	return strings.NewReplacer("/", "_", "+", "plus", "#", "hash").Replace(topic)
+}
+
+/* Settings entries for the --topic flags */
+func (args *ParsedArgs) topicEntries() []SettingsTopicEntry {
+	resetCron, _ := minutesCron(args.resetMinutes)
+	printCron, _ := secondsCron(args.printSeconds)
+	chartCron, _ := minutesCron(args.graphMinutes)
+
+	// a reset without save_json prints the stats to the console before it resets
+	if args.repr {
+		resetCron, printCron = printCron, ""
+	}
+
+	entries := make([]SettingsTopicEntry, 0, len(args.topics))
+	for _, topic := range args.topics {
+		entries = append(entries, SettingsTopicEntry{
+			FriendlyName:   topicFriendlyName(topic),
+			Topic:          topic,
+			SaveStatsCron:  printCron,
+			ResetStatsCron: resetCron,
+			SaveChartCron:  chartCron,
+		})
+	}
+	return entries
+}
+
+/*
+Splits off the command, everything but run & replay only gets its arguments in rest.
+flag.ErrHelp means the help was printed and nothing else should happen.
+*/
+func checkCmdArgs(cmdArgs []string) (ParsedArgs, error) {
+	args := ParsedArgs{command: COMMAND_RUN, speed: 1}
+
+	if len(cmdArgs) > 0 && !strings.HasPrefix(cmdArgs[0], "-") {
+		args.command = cmdArgs[0]
+		cmdArgs = cmdArgs[1:]
+	}
+
+	switch args.command {
+	case COMMAND_REPORT, COMMAND_DIFF, COMMAND_VALIDATE, COMMAND_VALIDATE_CONFIG, COMMAND_TOP:
+		args.rest = cmdArgs
+		return args, nil
+	case "help":
+		newRunFlagSet(COMMAND_RUN, &args).Usage()
+		return args, flag.ErrHelp
+	case COMMAND_RUN, COMMAND_REPLAY:
+	default:
+		printCommands(os.Stderr)
+		return args, fmt.Errorf("unknown command %q", args.command)
+	}
+
+	fs := newRunFlagSet(args.command, &args)
+	if err := fs.Parse(cmdArgs); err != nil {
+		return args, err
+	}
+
+	if args.command == COMMAND_REPLAY {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return args, errors.New("replay needs exactly one capture file")
+		}
+		args.replay = fs.Arg(0)
+		if len(args.path) == 0 {
+			args.path = args.replay + REPLAY_DIR_SUFFIX
+		}
+	} else if fs.NArg() > 0 {
+		return args, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
 
+	if args.graphMinutes > 0 {
+		args.graph = true
 	}
-	return retArgs, nil
+	return args, args.validate()
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCheckCmdArgs(t *testing.T) {
+	cases := []struct {
+		args    []string
+		command string
+		ok      bool
+	}{
+		{nil, COMMAND_RUN, true},
+		{[]string{"--url", "tcp://broker:1883", "--topic", "a/#"}, COMMAND_RUN, true},
+		{[]string{"run", "--topic", "a/#", "--reset", "15", "--print", "30"}, COMMAND_RUN, true},
+		{[]string{"report", "--anything", "goes"}, COMMAND_REPORT, true},
+		{[]string{"frobnicate"}, "frobnicate", false},
+		{[]string{"--url"}, COMMAND_RUN, false},
+		{[]string{"--unknown"}, COMMAND_RUN, false},
+		{[]string{"run", "extra"}, COMMAND_RUN, false},
+		{[]string{"--reset", "-5"}, COMMAND_RUN, false},
+		{[]string{"--print", "-1"}, COMMAND_RUN, false},
+		{[]string{"--grm", "-60"}, COMMAND_RUN, false},
+		{[]string{"--reset", "7"}, COMMAND_RUN, false},
+		{[]string{"--print", "45"}, COMMAND_RUN, false},
+		{[]string{"--grm", "300"}, COMMAND_RUN, false},
+		{[]string{"--topic", "a/#/b"}, COMMAND_RUN, false},
+		{[]string{"--repr", "--topic", "a/#"}, COMMAND_RUN, true},
+		{[]string{"--repr", "--print", "0"}, COMMAND_RUN, false},
+		{[]string{"--repr", "--reset", "15"}, COMMAND_RUN, false},
+		{[]string{"replay", "capture.jsonl"}, COMMAND_REPLAY, true},
+		{[]string{"replay", "--speed", "0", "capture.jsonl"}, COMMAND_REPLAY, true},
+		{[]string{"replay"}, COMMAND_REPLAY, false},
+		{[]string{"replay", "a.jsonl", "b.jsonl"}, COMMAND_REPLAY, false},
+		{[]string{"replay", "--speed", "-1", "capture.jsonl"}, COMMAND_REPLAY, false},
+		{[]string{"replay", "--url", "tcp://broker:1883", "capture.jsonl"}, COMMAND_REPLAY, false},
+	}
+	for _, c := range cases {
+		args, err := checkCmdArgs(c.args)
+		if (err == nil) != c.ok {
+			t.Errorf("%q gave %v, ok %t expected", c.args, err, c.ok)
+		}
+		if args.command != c.command {
+			t.Errorf("%q is command %q, expected %q", c.args, args.command, c.command)
+		}
+	}
+
+	args, err := checkCmdArgs([]string{"replay", "capture.jsonl"})
+	if err != nil || args.replay != "capture.jsonl" || args.path != "capture.jsonl"+REPLAY_DIR_SUFFIX {
+		t.Errorf("replay of capture.jsonl into %q: %v", args.path, err)
+	}
+	args, err = checkCmdArgs([]string{"report", "--from", "24h"})
+	if err != nil || !slices.Equal(args.rest, []string{"--from", "24h"}) {
+		t.Errorf("report got %q: %v", args.rest, err)
+	}
+}
+
+func TestMinutesAndSecondsCron(t *testing.T) {
+	cases := []struct {
+		n       int
+		seconds bool
+		cron    string
+		ok      bool
+	}{
+		{0, false, "", true},
+		{15, false, "0 */15 * * * *", true},
+		{1, false, "0 */1 * * * *", true},
+		{120, false, "0 0 */2 * * *", true},
+		{1440, false, "0 0 */24 * * *", true},
+		{7, false, "", false},
+		{90, false, "", false},
+		{300, false, "", false},
+		{2880, false, "", false},
+		{0, true, "", true},
+		{20, true, "*/20 * * * * *", true},
+		{60, true, "0 */1 * * * *", true},
+		{180, true, "0 */3 * * * *", true},
+		{45, true, "", false},
+		{90, true, "", false},
+		{420, true, "", false},
+	}
+	for _, c := range cases {
+		cronFunc, name := minutesCron, "minutesCron"
+		if c.seconds {
+			cronFunc, name = secondsCron, "secondsCron"
+		}
+		cron, err := cronFunc(c.n)
+		if (err == nil) != c.ok || cron != c.cron {
+			t.Errorf("%s(%d) = %q, %v, expected %q ok %t", name, c.n, cron, err, c.cron, c.ok)
+		}
+	}
+}
+
+func TestTopicEntriesRepr(t *testing.T) {
+	args := ParsedArgs{topics: []string{"a/#"}, printSeconds: 30, repr: true}
+	entries := args.topicEntries()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, expected 1", len(entries))
+	}
+	// no save_json, the reset prints the stats
+	if e := entries[0]; e.SaveStatsCron != "" || e.ResetStatsCron != "*/30 * * * * *" {
+		t.Errorf("--repr entry saves at %q & resets at %q", e.SaveStatsCron, e.ResetStatsCron)
+	}
+
+	args.repr = false
+	if e := args.topicEntries()[0]; e.SaveStatsCron != "*/30 * * * * *" || e.ResetStatsCron != "" {
+		t.Errorf("entry saves at %q & resets at %q", e.SaveStatsCron, e.ResetStatsCron)
+	}
+}
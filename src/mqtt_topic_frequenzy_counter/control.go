@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CONTROL_ADD_WATCH    = "add_watch"
+	CONTROL_REMOVE_WATCH = "remove_watch"
+	CONTROL_RESET        = "reset"
+	CONTROL_SNAPSHOT     = "snapshot"
+	CONTROL_EXCLUDE      = "exclude"
+	CONTROL_DUMP_TOP     = "dump_top"
+
+	/* Highest identifier MQTT allows, the ones of the TopicProcs count up from 1 */
+	CONTROL_SUB_ID = 268435455
+)
+
+/*
+topic: JSON commands are accepted on this topic, see controlCommand (empty = off)
+reply_topic: responses go here if the command has no MQTT v5 response topic (empty = only v5 responses)
+
+What the commands change isn't written to the settings file,
+a reload (SIGHUP) goes back to what the file says.
+*/
+type SettingsControl struct {
+	Topic      string `yaml:"topic"`
+	ReplyTopic string `yaml:"reply_topic"`
+}
+
+/* The control settings of this connection, they only change with a restart */
+var controlSettings SettingsControl
+
+func (c SettingsControl) validate() []error {
+	errs := make([]error, 0)
+	if len(c.Topic) > 0 {
+		if err := validateTopicFilter(c.Topic); err != nil {
+			errs = append(errs, fmt.Errorf("topic: %w", err))
+		}
+	}
+	if len(c.ReplyTopic) > 0 {
+		if err := validatePublishTopic(c.ReplyTopic); err != nil {
+			errs = append(errs, fmt.Errorf("reply_topic: %w", err))
+		} else if len(c.Topic) > 0 && topicMatchesFilter(c.Topic, c.ReplyTopic) {
+			errs = append(errs, fmt.Errorf("reply_topic: %q matches topic, every response would be read as a command", c.ReplyTopic))
+		}
+	}
+	return errs
+}
+
+/* Responses always carry ok, commands never do */
+func isControlResponse(payload []byte) bool {
+	var probe struct {
+		Ok *bool `json:"ok"`
+	}
+	return json.Unmarshal(payload, &probe) == nil && probe.Ok != nil
+}
+
+var (
+	errBadCommand   = errors.New("bad command")
+	errUnknownWatch = errors.New("unknown friendly_name")
+	errWatchExists  = errors.New("friendly_name is already used")
+)
+
+/*
+{"command": "add_watch", "friendly_name": "lights", "topic": "zigbee2mqtt/+/light"}
+{"command": "add_watch", "watch": {...}} takes all keys of a topics entry
+{"command": "remove_watch", "friendly_name": "lights"}
+{"command": "reset"} / {"command": "snapshot"} for every entry or the one in friendly_name
+{"command": "exclude", "friendly_name": "lights", "pattern": "zigbee2mqtt/bridge/#"}
+{"command": "dump_top", "friendly_name": "lights", "n": 5}
+id is copied into the response for clients without MQTT v5 correlation data.
+*/
+type controlCommand struct {
+	ID           string          `json:"id,omitempty"`
+	Command      string          `json:"command"`
+	FriendlyName string          `json:"friendly_name,omitempty"`
+	Topic        string          `json:"topic,omitempty"`
+	Pattern      string          `json:"pattern,omitempty"`
+	N            int             `json:"n,omitempty"`
+	Watch        json.RawMessage `json:"watch,omitempty"`
+}
+
+type controlResponse struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	Result  any    `json:"result,omitempty"`
+}
+
+type watchInfo struct {
+	FriendlyName string    `json:"friendly_name"`
+	Topic        string    `json:"topic"`
+	Topics       int       `json:"topics"`
+	WindowStart  time.Time `json:"window_start"`
+	Excluded     []string  `json:"exclude_topics"`
+	Included     []string  `json:"include_topics"`
+}
+
+func (d *TopicProc) info() watchInfo {
+	topics := len(d.snapshotRows())
+
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+	_, _, windowStart := d._current(clock.Now())
+	return watchInfo{
+		FriendlyName: d.friendlyName,
+		Topic:        d.baseTopic,
+		Topics:       topics,
+		WindowStart:  windowStart,
+		Excluded:     slices.Clone(d._setting.IgnoreTopics),
+		Included:     slices.Clone(d._setting.IncludeTopics),
+	}
+}
+
+/* Stops counting topics matching raw from now on */
+func (d *TopicProc) addExclude(raw string) error {
+	pattern, err := compileTopicPattern(raw)
+	if err != nil {
+		return err
+	}
+
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+	d._exc_topics = append(slices.Clip(d._exc_topics), pattern)
+	// a reload compares against this, an entry changed at runtime is recreated from the file
+	d._setting.IgnoreTopics = append(slices.Clip(d._setting.IgnoreTopics), raw)
+	return nil
+}
+
+/* The named TopicProc, every one if name is empty */
+func watchTargets(name string) ([]*TopicProc, error) {
+	if len(name) == 0 {
+		return currentTopicProcs(), nil
+	}
+	tp := findTopicProc(name)
+	if tp == nil {
+		return nil, fmt.Errorf("%w %q", errUnknownWatch, name)
+	}
+	return []*TopicProc{tp}, nil
+}
+
+func watchNames(procs []*TopicProc) []string {
+	names := make([]string, 0, len(procs))
+	for _, tp := range procs {
+		names = append(names, tp.friendlyName)
+	}
+	return names
+}
+
+/* Runs a command, shared by the control topic & the http api */
+func (s *supervisor) execute(cmd controlCommand) (any, error) {
+	switch cmd.Command {
+	case CONTROL_ADD_WATCH:
+		return s.addWatch(cmd)
+	case CONTROL_REMOVE_WATCH:
+		return s.removeWatch(cmd.FriendlyName)
+	case CONTROL_RESET:
+		procs, err := watchTargets(cmd.FriendlyName)
+		if err != nil {
+			return nil, err
+		}
+		for _, tp := range procs {
+			tp.ResetStats()
+		}
+		return watchNames(procs), nil
+	case CONTROL_SNAPSHOT:
+		procs, err := watchTargets(cmd.FriendlyName)
+		if err != nil {
+			return nil, err
+		}
+		errs := make([]error, 0)
+		for _, tp := range procs {
+			errs = append(errs, tp.writeToJsonFile(false), tp.writeGraph())
+		}
+		return watchNames(procs), errors.Join(errs...)
+	case CONTROL_EXCLUDE:
+		if len(cmd.FriendlyName) == 0 || len(cmd.Pattern) == 0 {
+			return nil, fmt.Errorf("%w: friendly_name & pattern required", errBadCommand)
+		}
+		tp := findTopicProc(cmd.FriendlyName)
+		if tp == nil {
+			return nil, fmt.Errorf("%w %q", errUnknownWatch, cmd.FriendlyName)
+		}
+		if err := tp.addExclude(cmd.Pattern); err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadCommand, err)
+		}
+		return tp.info(), nil
+	case CONTROL_DUMP_TOP:
+		if cmd.N < 0 {
+			return nil, fmt.Errorf("%w: n can't be negative", errBadCommand)
+		}
+		procs, err := watchTargets(cmd.FriendlyName)
+		if err != nil {
+			return nil, err
+		}
+		n := getBetterInt(cmd.N, DEFAULT_STATS_TOP_N)
+		summaries := make([]topicSummary, 0, len(procs))
+		for _, tp := range procs {
+			summaries = append(summaries, tp.buildSummary(n, clock.Now()))
+		}
+		return summaries, nil
+	}
+	return nil, fmt.Errorf("%w: unknown command %q", errBadCommand, cmd.Command)
+}
+
+/* The entry of an add_watch, either the watch object or friendly_name & topic */
+func (cmd controlCommand) watchEntry() (SettingsTopicEntry, error) {
+	entry := SettingsTopicEntry{FriendlyName: cmd.FriendlyName, Topic: cmd.Topic}
+	if len(cmd.Watch) == 0 {
+		return entry, nil
+	}
+
+	// JSON is YAML, this way the keys are the same as in the settings file
+	dec := yaml.NewDecoder(bytes.NewReader(cmd.Watch))
+	dec.KnownFields(true)
+	if err := dec.Decode(&entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+func (s *supervisor) addWatch(cmd controlCommand) (any, error) {
+	entry, err := cmd.watchEntry()
+	if err != nil {
+		return nil, fmt.Errorf("%w: watch: %w", errBadCommand, err)
+	}
+	if errs := entry.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", errBadCommand, errors.Join(errs...))
+	}
+
+	s._mutex.Lock()
+	defer s._mutex.Unlock()
+
+	name := entry.name()
+	if findTopicProc(name) != nil {
+		return nil, fmt.Errorf("%w: %q", errWatchExists, name)
+	}
+	tp, err := setupTopicProc(entry, s.settings, s.rules, s.sched, s.fman)
+	if err != nil {
+		return nil, err
+	}
+	s.swapTopicProcs(func(procs []*TopicProc) []*TopicProc {
+		return append(procs, tp)
+	})
+	InfoLogger.Printf("Control: watching %s (%s)\n", tp.baseTopic, tp.friendlyName)
+	return tp.info(), nil
+}
+
+func (s *supervisor) removeWatch(name string) (any, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("%w: friendly_name required", errBadCommand)
+	}
+
+	s._mutex.Lock()
+	defer s._mutex.Unlock()
+
+	tp := findTopicProc(name)
+	if tp == nil {
+		return nil, fmt.Errorf("%w %q", errUnknownWatch, name)
+	}
+	s.swapTopicProcs(func(procs []*TopicProc) []*TopicProc {
+		return slices.DeleteFunc(procs, func(other *TopicProc) bool { return other == tp })
+	})
+	s.retire(tp)
+	InfoLogger.Printf("Control: stopped watching %s (%s)\n", tp.baseTopic, tp.friendlyName)
+	return tp.info(), nil
+}
+
+func isControlMessage(p *paho.Publish) bool {
+	if len(controlSettings.Topic) == 0 {
+		return false
+	}
+	if p.Properties != nil && p.Properties.SubscriptionIdentifier != nil {
+		return *p.Properties.SubscriptionIdentifier == CONTROL_SUB_ID
+	}
+	return topicMatchesFilter(controlSettings.Topic, p.Topic)
+}
+
+/* Runs the command of a control message & publishes the response, not on pahos goroutine as it publishes */
+func handleControlMessage(p *paho.Publish) {
+	// answering a response, ours or another instances, would never end
+	if isControlResponse(p.Payload) {
+		return
+	}
+
+	resp := controlResponse{}
+	var cmd controlCommand
+	if err := json.Unmarshal(p.Payload, &cmd); err != nil {
+		resp.Error = fmt.Sprintf("%s: %s", errBadCommand, err)
+	} else {
+		resp.ID = cmd.ID
+		resp.Command = cmd.Command
+		resp.Result, err = topicSupervisor.execute(cmd)
+		resp.Ok = err == nil
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+	InfoLogger.Printf("Control: %s %q ok: %t %s\n", p.Topic, resp.Command, resp.Ok, resp.Error)
+
+	reply := &paho.Publish{Topic: controlSettings.ReplyTopic, QoS: 1}
+	if p.Properties != nil {
+		if len(p.Properties.ResponseTopic) > 0 {
+			reply.Topic = p.Properties.ResponseTopic
+		}
+		if len(p.Properties.CorrelationData) > 0 {
+			reply.Properties = &paho.PublishProperties{CorrelationData: p.Properties.CorrelationData}
+		}
+	}
+	if len(reply.Topic) == 0 {
+		return
+	}
+	if topicMatchesFilter(controlSettings.Topic, reply.Topic) {
+		WarningLogger.Printf("Control: not responding to %s, it is part of the control topic\n", reply.Topic)
+		return
+	}
+
+	var err error
+	if reply.Payload, err = json.Marshal(resp); err != nil {
+		ErrorLogger.Printf("Control: encoding the response failed: %s\n", err)
+		return
+	}
+	if err = publishPacket(reply); err != nil {
+		ErrorLogger.Printf("Control: publishing the response to %s failed: %s\n", reply.Topic, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSettingsTopicEntryName(t *testing.T) {
+	cases := []struct {
+		entry SettingsTopicEntry
+		name  string
+	}{
+		{SettingsTopicEntry{FriendlyName: "lights", Topic: "zigbee2mqtt/#"}, "lights"},
+		{SettingsTopicEntry{Topic: "zigbee2mqtt/#"}, "zigbee2mqtt_hash"},
+		{SettingsTopicEntry{Topic: "a/+/set"}, "a_plus_set"},
+		{SettingsTopicEntry{Topic: "sensors"}, "sensors"},
+	}
+	for _, c := range cases {
+		if got := c.entry.name(); got != c.name {
+			t.Errorf("name of %+v = %q, expected %q", c.entry, got, c.name)
+		}
+	}
+}
+
+func TestSettingsTopicEntryFriendlyNameInPath(t *testing.T) {
+	for _, name := range []string{"../../x", "a/b", `a\b`, "/etc"} {
+		if errs := (SettingsTopicEntry{FriendlyName: name, Topic: "a/#"}).validate(); len(errs) == 0 {
+			t.Errorf("friendly_name %q was accepted", name)
+		}
+	}
+	if errs := (SettingsTopicEntry{FriendlyName: "From Zigbee Network", Topic: "a/#"}).validate(); len(errs) != 0 {
+		t.Errorf("a plain friendly_name gave %v", errs)
+	}
+}
+
+func TestAddWatchFileNames(t *testing.T) {
+	sched := newTestScheduler(t)
+	dir := t.TempDir()
+	s := &supervisor{ctx: context.Background(), settings: &SettingsStruct{}, sched: sched, fman: &fileman{working_directory: dir}}
+
+	saved := topicProcs
+	t.Cleanup(func() { topicProcs = saved })
+	topicProcs = nil
+
+	if _, err := s.execute(controlCommand{Command: CONTROL_ADD_WATCH, FriendlyName: "../../x", Topic: "a/#"}); !errors.Is(err, errBadCommand) {
+		t.Errorf("a friendly_name out of path gave %v", err)
+	}
+
+	// unnamed entries used to get their topic as file name
+	if _, err := s.execute(controlCommand{Command: CONTROL_ADD_WATCH, Topic: "a/#"}); err != nil {
+		t.Fatal(err)
+	}
+	tp := findTopicProc("a_hash")
+	if tp == nil {
+		t.Fatal("the unnamed watch isn't called a_hash")
+	}
+	if err := tp.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a_hash.state.json")); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.execute(controlCommand{Command: CONTROL_REMOVE_WATCH, FriendlyName: "a_hash"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettingsControlValidate(t *testing.T) {
+	cases := []struct {
+		settings SettingsControl
+		valid    bool
+	}{
+		{SettingsControl{}, true},
+		{SettingsControl{Topic: "mtf/control", ReplyTopic: "mtf/reply"}, true},
+		{SettingsControl{Topic: "mtf/control/#", ReplyTopic: "mtf/reply"}, true},
+		{SettingsControl{Topic: "mtf/control/#", ReplyTopic: "mtf/control/reply"}, false},
+		{SettingsControl{Topic: "mtf/+", ReplyTopic: "mtf/reply"}, false},
+		{SettingsControl{Topic: "mtf/control", ReplyTopic: "mtf/control"}, false},
+		{SettingsControl{Topic: "mtf/control", ReplyTopic: "mtf/#"}, false},
+		{SettingsControl{Topic: "mtf/#/control"}, false},
+	}
+	for _, c := range cases {
+		if errs := c.settings.validate(); (len(errs) == 0) != c.valid {
+			t.Errorf("%+v gave %v, valid %t expected", c.settings, errs, c.valid)
+		}
+	}
+}
+
+func TestIsControlResponse(t *testing.T) {
+	cases := map[string]bool{
+		`{"command": "reset"}`:                                 false,
+		`{"id": "1", "command": "dump_top", "n": 3}`:           false,
+		`{"command": "reset", "ok": true, "result": ["a"]}`:    true,
+		`{"command": "", "ok": false, "error": "bad command"}`: true,
+		`not json`: false,
+	}
+	for payload, want := range cases {
+		if got := isControlResponse([]byte(payload)); got != want {
+			t.Errorf("isControlResponse(%s) = %t, expected %t", payload, got, want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DIFF_APPEARED    = "appeared"
+	DIFF_DISAPPEARED = "disappeared"
+	DIFF_INCREASED   = "increased"
+	DIFF_DECREASED   = "decreased"
+	DIFF_UNCHANGED   = "unchanged"
+
+	DIFF_FORMAT_TEXT = "text"
+	DIFF_FORMAT_JSON = "json"
+)
+
+/*
+Summed up counts of one side, Seconds is 0 if the length is unknown (a single old snapshot).
+Seconds only counts the time covered by snapshots, a gap while nothing ran doesn't lower the rates.
+*/
+type diffPeriod struct {
+	Label     string       `json:"label"`
+	From      time.Time    `json:"from"`
+	To        time.Time    `json:"to"`
+	Seconds   float64      `json:"seconds"`
+	Snapshots int          `json:"snapshots"`
+	Messages  topicByteMap `json:"-"`
+}
+
+/* Per second if the length of the period is known, the plain count otherwise */
+func (p *diffPeriod) rate(topic string) float64 {
+	if p.Seconds <= 0 {
+		return float64(p.Messages[topic])
+	}
+	return perSecond(p.Messages[topic], p.Seconds)
+}
+
+func newDiffPeriod(label string, snapshots []snapshot) diffPeriod {
+	p := diffPeriod{Label: label, Snapshots: len(snapshots), Messages: make(topicByteMap)}
+	if len(snapshots) == 0 {
+		return p
+	}
+	p.From = snapshots[0].Start
+	p.To = snapshots[len(snapshots)-1].Time
+	for _, s := range snapshots {
+		p.Seconds += s.Time.Sub(s.Start).Seconds()
+		for topic, val := range s.Messages {
+			p.Messages[topic] += val
+		}
+	}
+	return p
+}
+
+/* A single snapshot file, the time comes from the name or else from the file */
+func loadSnapshotFile(path string) (snapshot, error) {
+	name := strings.TrimSuffix(filepath.Base(path), ".json")
+	t, err := time.Parse(time.RFC3339, name[strings.LastIndex(name, "_")+1:])
+	if err != nil {
+		info, serr := os.Stat(path)
+		if serr != nil {
+			return snapshot{}, serr
+		}
+		t = info.ModTime()
+	}
+
+	s, err := readSnapshot(path, t)
+	if err != nil {
+		return s, err
+	}
+	s.Start = s.Time
+	if s.since != nil {
+		s.Start = *s.since
+	}
+	return s, nil
+}
+
+type diffEntry struct {
+	Topic         string   `json:"topic"`
+	Status        string   `json:"status"`
+	AMessages     uint64   `json:"a_messages"`
+	BMessages     uint64   `json:"b_messages"`
+	ARate         float64  `json:"a_rate"`
+	BRate         float64  `json:"b_rate"`
+	Change        float64  `json:"change"`
+	ChangePercent *float64 `json:"change_percent"`
+	Flagged       bool     `json:"flagged"`
+}
+
+type diffResult struct {
+	A                diffPeriod  `json:"a"`
+	B                diffPeriod  `json:"b"`
+	PerSecond        bool        `json:"per_second"`
+	ThresholdPercent float64     `json:"threshold_percent"`
+	Topics           []diffEntry `json:"topics"`
+}
+
+/*
+Compares the rate of every topic, topics below minMessages on both sides are left out.
+Appeared & disappeared topics are always flagged, others if they changed by at least threshold percent.
+*/
+func diffPeriods(a diffPeriod, b diffPeriod, threshold float64, minMessages uint64) diffResult {
+	res := diffResult{A: a, B: b, PerSecond: a.Seconds > 0 && b.Seconds > 0, ThresholdPercent: threshold}
+	if !res.PerSecond {
+		// mixing rates & counts would be meaningless
+		a.Seconds, b.Seconds = 0, 0
+	}
+
+	unique := UniqueStringArray{array: make(map[string]bool)}
+	for _, m := range []topicByteMap{a.Messages, b.Messages} {
+		topics, _ := MapKeys(m)
+		unique.AddStrings(topics...)
+	}
+	topics, _ := unique.getStrings()
+
+	for _, topic := range topics {
+		e := diffEntry{
+			Topic:     topic,
+			AMessages: a.Messages[topic],
+			BMessages: b.Messages[topic],
+			ARate:     a.rate(topic),
+			BRate:     b.rate(topic),
+		}
+		if max(e.AMessages, e.BMessages) < minMessages || e.AMessages+e.BMessages == 0 {
+			continue
+		}
+		e.Change = e.BRate - e.ARate
+
+		switch {
+		case e.AMessages == 0:
+			e.Status = DIFF_APPEARED
+			e.Flagged = true
+		case e.BMessages == 0:
+			e.Status = DIFF_DISAPPEARED
+			e.Flagged = true
+		default:
+			pct := e.Change / e.ARate * 100
+			e.ChangePercent = &pct
+			e.Flagged = math.Abs(pct) >= threshold
+			e.Status = DIFF_UNCHANGED
+			if e.Flagged && pct > 0 {
+				e.Status = DIFF_INCREASED
+			} else if e.Flagged {
+				e.Status = DIFF_DECREASED
+			}
+		}
+		res.Topics = append(res.Topics, e)
+	}
+
+	sort.SliceStable(res.Topics, func(i, j int) bool {
+		ci, cj := math.Abs(res.Topics[i].Change), math.Abs(res.Topics[j].Change)
+		if ci != cj {
+			return ci > cj
+		}
+		return res.Topics[i].Topic < res.Topics[j].Topic
+	})
+	return res
+}
+
+func (res *diffResult) writeText(w io.Writer, onlyFlagged bool) error {
+	const stamp = "2006-01-02 15:04"
+	for _, p := range []diffPeriod{res.A, res.B} {
+		fmt.Fprintf(w, "%s: %s - %s (%d snapshots)\n", p.Label, p.From.Format(stamp), p.To.Format(stamp), p.Snapshots)
+	}
+	unit := "msg/s"
+	if !res.PerSecond {
+		unit = "messages"
+		fmt.Fprintln(w, "The length of a period is unknown, comparing message counts instead of rates")
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "A %s\tB %s\tchange\tchange %%\tstatus\t  topic\n", unit, unit)
+	for _, e := range res.Topics {
+		if onlyFlagged && !e.Flagged {
+			continue
+		}
+		pct := "-"
+		if e.ChangePercent != nil {
+			pct = fmt.Sprintf("%+.1f%%", *e.ChangePercent)
+		}
+		mark := ""
+		if e.Flagged {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%.4f\t%.4f\t%+.4f\t%s\t%s%s\t  %s\n", e.ARate, e.BRate, e.Change, pct, mark, e.Status, e.Topic)
+	}
+	return tw.Flush()
+}
+
+func (res *diffResult) writeJSON(w io.Writer, onlyFlagged bool) error {
+	out := *res
+	if onlyFlagged {
+		out.Topics = make([]diffEntry, 0, len(res.Topics))
+		for _, e := range res.Topics {
+			if e.Flagged {
+				out.Topics = append(out.Topics, e)
+			}
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+/*
+diff subcommand, returns the exit code.
+Either two snapshot files as arguments or two time ranges of one friendly name.
+*/
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	config := fs.String("config", "", "settings file, its path is where the snapshots are read from")
+	cwd := fs.String("cwd", "", "directory with the snapshots, overrides the settings path")
+	name := fs.String("name", "", "friendly name (default the only one found)")
+	aFrom := fs.String("a-from", "", "start of period A, RFC3339, YYYY-MM-DD or a duration ago like 168h")
+	aTo := fs.String("a-to", "", "end of period A")
+	bFrom := fs.String("b-from", "", "start of period B")
+	bTo := fs.String("b-to", "", "end of period B")
+	threshold := fs.Float64("threshold", 20, "flag topics whose rate changed by at least this many percent")
+	minMessages := fs.Uint64("min-messages", 0, "ignore topics with fewer messages in both periods")
+	onlyFlagged := fs.Bool("flagged", false, "only show flagged topics")
+	format := fs.String("format", DIFF_FORMAT_TEXT, "text or json")
+	out := fs.String("out", "", "output file (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: diff [flags] A.json B.json")
+		fmt.Fprintln(fs.Output(), "       diff [flags] -a-from ... -a-to ... -b-from ... -b-to ...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != DIFF_FORMAT_TEXT && *format != DIFF_FORMAT_JSON {
+		ErrorLogger.Printf("Unknown format %q, use text or json\n", *format)
+		return 2
+	}
+	if *threshold < 0 {
+		ErrorLogger.Println("-threshold has to be positive")
+		return 2
+	}
+
+	var a, b diffPeriod
+	switch fs.NArg() {
+	case 2:
+		for idx, path := range fs.Args() {
+			s, err := loadSnapshotFile(path)
+			if err != nil {
+				ErrorLogger.Println(err)
+				return 1
+			}
+			p := newDiffPeriod(filepath.Base(path), []snapshot{s})
+			if s.since == nil {
+				p.Seconds = 0
+			}
+			if idx == 0 {
+				a = p
+			} else {
+				b = p
+			}
+		}
+	case 0:
+		now := time.Now()
+		ranges := make([]time.Time, 0, 4)
+		for _, s := range []string{*aFrom, *aTo, *bFrom, *bTo} {
+			t, err := parseReportTime(s, now)
+			if err != nil {
+				ErrorLogger.Println(err)
+				return 2
+			}
+			ranges = append(ranges, t)
+		}
+		if ranges[0].IsZero() && ranges[1].IsZero() || ranges[2].IsZero() && ranges[3].IsZero() {
+			ErrorLogger.Println("Both periods need at least a start or an end")
+			fs.Usage()
+			return 2
+		}
+
+		dir := reportDirectory(*config, *cwd)
+		friendlyName, err := reportFriendlyName(dir, *name)
+		if err != nil {
+			ErrorLogger.Println(err)
+			return 1
+		}
+		for idx, label := range []string{"A", "B"} {
+			snapshots, err := loadSnapshots(dir, friendlyName, ranges[idx*2], ranges[idx*2+1])
+			if err != nil {
+				ErrorLogger.Println(err)
+				return 1
+			}
+			if len(snapshots) == 0 {
+				ErrorLogger.Printf("No snapshots of %s in %s for period %s\n", friendlyName, dir, label)
+				return 1
+			}
+			if idx == 0 {
+				a = newDiffPeriod(label, snapshots)
+			} else {
+				b = newDiffPeriod(label, snapshots)
+			}
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	res := diffPeriods(a, b, *threshold, *minMessages)
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			ErrorLogger.Println(err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	if *format == DIFF_FORMAT_JSON {
+		err = res.writeJSON(w, *onlyFlagged)
+	} else {
+		err = res.writeText(w, *onlyFlagged)
+	}
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 1
+	}
+	return 0
+}
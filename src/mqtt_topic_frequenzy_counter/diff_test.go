@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadSnapshotFile(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := loadSnapshotFile(writeTestFile(t, dir, "z_2024-03-01T12:00:00Z.json", `{"a": 4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Time.Equal(testEpoch) || !s.Start.Equal(testEpoch) || s.HasBytes || s.Messages["a"] != 4 {
+		t.Errorf("old format: %+v", s)
+	}
+
+	s, err = loadSnapshotFile(writeTestFile(t, dir, "z_2024-03-01T12:00:00Z.json",
+		`{"since": "2024-03-01T11:00:00Z", "until": "2024-03-01T12:00:00Z", "messages": {"a": 4}, "bytes": {"a": 40}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Start.Equal(testEpoch.Add(-time.Hour)) || !s.Time.Equal(testEpoch) || !s.HasBytes || s.Bytes["a"] != 40 {
+		t.Errorf("new format: %+v", s)
+	}
+
+	// without a time in the name the file itself tells when it was written
+	path := writeTestFile(t, dir, "copy.json", `{"a": 1}`)
+	if err = os.Chtimes(path, testEpoch, testEpoch); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = loadSnapshotFile(path); err != nil || !s.Time.Equal(testEpoch) {
+		t.Errorf("copy.json: time %s, %v, expected the modification time", s.Time, err)
+	}
+
+	if _, err = loadSnapshotFile(writeTestFile(t, dir, "broken.json", "[")); err == nil {
+		t.Error("broken.json was loaded without an error")
+	}
+	if _, err = loadSnapshotFile(dir + "/missing.json"); err == nil {
+		t.Error("missing.json was loaded without an error")
+	}
+}
+
+func TestNewDiffPeriod(t *testing.T) {
+	p := newDiffPeriod("a", []snapshot{
+		{Start: testEpoch, Time: testEpoch.Add(time.Minute), Messages: topicByteMap{"x": 2}},
+		{Start: testEpoch.Add(time.Minute), Time: testEpoch.Add(2 * time.Minute), Messages: topicByteMap{"x": 4, "y": 1}},
+	})
+	if p.Seconds != 120 || p.Snapshots != 2 || p.Messages["x"] != 6 || p.Messages["y"] != 1 {
+		t.Errorf("period %+v", p)
+	}
+	if got := p.rate("x"); got != 0.05 {
+		t.Errorf("rate of x %g, expected 0.05", got)
+	}
+
+	// the hour in between wasn't recorded
+	p = newDiffPeriod("gap", []snapshot{
+		{Start: testEpoch, Time: testEpoch.Add(time.Minute), Messages: topicByteMap{"x": 6}},
+		{Start: testEpoch.Add(time.Hour), Time: testEpoch.Add(time.Hour + time.Minute), Messages: topicByteMap{"x": 6}},
+	})
+	if p.Seconds != 120 || p.rate("x") != 0.1 {
+		t.Errorf("period with a gap: %g seconds, rate of x %g, expected 120 & 0.1", p.Seconds, p.rate("x"))
+	}
+
+	if p = newDiffPeriod("empty", nil); p.Seconds != 0 || len(p.Messages) != 0 {
+		t.Errorf("empty period %+v", p)
+	}
+}
+
+func TestDiffPeriods(t *testing.T) {
+	a := diffPeriod{Seconds: 100, Messages: topicByteMap{"same": 100, "up": 100, "down": 100, "gone": 50, "rare": 2}}
+	b := diffPeriod{Seconds: 200, Messages: topicByteMap{"same": 210, "up": 400, "down": 100, "new": 20, "rare": 1}}
+
+	res := diffPeriods(a, b, 20, 5)
+	if !res.PerSecond {
+		t.Error("both periods have a length, expected rates")
+	}
+	want := map[string]struct {
+		status  string
+		flagged bool
+	}{
+		"up":   {DIFF_INCREASED, true},
+		"down": {DIFF_DECREASED, true},
+		"same": {DIFF_UNCHANGED, false},
+		"gone": {DIFF_DISAPPEARED, true},
+		"new":  {DIFF_APPEARED, true},
+	}
+	if len(res.Topics) != len(want) {
+		t.Errorf("%d topics, expected %d (rare is below min messages)", len(res.Topics), len(want))
+	}
+	for _, e := range res.Topics {
+		w, ok := want[e.Topic]
+		if !ok || e.Status != w.status || e.Flagged != w.flagged {
+			t.Errorf("%s: %s flagged %t, expected %+v", e.Topic, e.Status, e.Flagged, w)
+		}
+	}
+	// ordered by the absolute change of the rate: up +1/s, down -0.5/s, gone -0.5/s, new +0.1/s, same +0.05/s
+	order := []string{"up", "down", "gone", "new", "same"}
+	for i, e := range res.Topics {
+		if i < len(order) && e.Topic != order[i] {
+			t.Errorf("topic %d is %s, expected %s", i, e.Topic, order[i])
+		}
+	}
+
+	// a single old snapshot has no length, both sides are compared by count then
+	res = diffPeriods(diffPeriod{Messages: topicByteMap{"x": 10}}, b, 20, 0)
+	if res.PerSecond {
+		t.Error("a period without a length gave rates")
+	}
+	for _, e := range res.Topics {
+		if e.Topic == "x" && (e.ARate != 10 || e.Status != DIFF_DISAPPEARED) {
+			t.Errorf("x: %+v", e)
+		}
+		if e.Topic == "up" && e.BRate != 400 {
+			t.Errorf("up: rate %g, expected the count 400", e.BRate)
+		}
+	}
+}
+
+/* A steady topic whose save_json changed between A & B isn't flagged */
+func TestDiffPeriodsFromSnapshots(t *testing.T) {
+	cases := []struct {
+		name       string
+		entry      SettingsTopicEntry
+		aEvery     int
+		bEvery     int
+		resetEvery int
+	}{
+		{"without reset_data", SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"}, 1, 5, 0},
+		{"with reset_data", SettingsTopicEntry{FriendlyName: "t", Topic: "a/#", ResetStatsCron: "0 0 * * * *"}, 10, 30, 60},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newTopicFeed(t, c.entry)
+			f.run(60, 6, c.aEvery, c.resetEvery)
+			f.run(60, 6, c.bEvery, c.resetEvery)
+
+			periods := make([]diffPeriod, 0, 2)
+			for _, r := range [][2]time.Time{
+				{testEpoch, testEpoch.Add(time.Hour)},
+				{testEpoch.Add(time.Hour + time.Minute), testEpoch.Add(2 * time.Hour)},
+			} {
+				snapshots, err := loadSnapshots(f.dir, "t", r[0], r[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				periods = append(periods, newDiffPeriod("", snapshots))
+			}
+			for i, p := range periods {
+				if p.Seconds != 3600 || p.Messages["a/b"] != 360 {
+					t.Errorf("period %d: %g seconds with %d messages, expected the 360 of an hour", i, p.Seconds, p.Messages["a/b"])
+				}
+			}
+
+			res := diffPeriods(periods[0], periods[1], 5, 0)
+			if len(res.Topics) != 1 || res.Topics[0].Status != DIFF_UNCHANGED || res.Topics[0].Flagged {
+				t.Errorf("diff of a steady topic: %+v", res.Topics)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -10,8 +11,7 @@ type fileman struct {
 	working_directory string
 }
 
-func (f *fileman) getFileWithTimestamp(prepend string, middle string, extension string) (*os.File, error) {
-	formatted := time.Now().Format(time.RFC3339)
+func (f *fileman) getDirectory() string {
 	cwd := f.working_directory
 
 	if len(f.working_directory) < 1 {
@@ -23,6 +23,12 @@ func (f *fileman) getFileWithTimestamp(prepend string, middle string, extension
 			fmt.Println(err_cwd)
 		}
 	}
+	return cwd
+}
+
+func (f *fileman) getFileWithTimestamp(prepend string, middle string, extension string) (*os.File, error) {
+	formatted := clock.Now().Format(time.RFC3339)
+	cwd := f.getDirectory()
 
 	var filePath = ""
 	if len(middle) > 0 {
@@ -32,3 +38,31 @@ func (f *fileman) getFileWithTimestamp(prepend string, middle string, extension
 	}
 	return os.Create(filePath)
 }
+
+/* Writes to a temp file first and renames it, so a crash never leaves a half written file behind */
+func (f *fileman) writeFileAtomic(name string, data []byte) error {
+	filePath := filepath.Join(f.getDirectory(), name)
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func (f *fileman) readFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(f.getDirectory(), name))
+}
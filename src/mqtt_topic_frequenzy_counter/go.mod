@@ -8,13 +8,17 @@ require (
 	github.com/go-echarts/go-echarts/v2 v2.3.3
 )
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.1
+	github.com/jonboulle/clockwork v0.4.0
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.1 // indirect
-	github.com/jonboulle/clockwork v0.4.0 // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
 	golang.org/x/exp v0.0.0-20231219180239-dc181d75b848 // indirect
 	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
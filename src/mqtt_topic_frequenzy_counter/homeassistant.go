@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HA_DISCOVERY_PREFIX = "homeassistant"
+	DEFAULT_HA_STATE_PREFIX     = "mqtt_topic_freq"
+	HA_MANUFACTURER             = "mqtt_topic_freq"
+)
+
+/*
+enabled: every observed topic becomes a device with messages, bytes & last seen sensors
+discovery_prefix: home assistants discovery prefix (default homeassistant)
+state_prefix: the sensor states are published below this topic (default mqtt_topic_freq)
+*/
+type SettingsHomeAssistant struct {
+	Enabled         bool   `yaml:"enabled"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	StatePrefix     string `yaml:"state_prefix"`
+}
+
+func (s SettingsHomeAssistant) discoveryPrefix() string {
+	return getBetterStringNoErr(s.DiscoveryPrefix, DEFAULT_HA_DISCOVERY_PREFIX)
+}
+
+func (s SettingsHomeAssistant) statePrefix() string {
+	return getBetterStringNoErr(s.StatePrefix, DEFAULT_HA_STATE_PREFIX)
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	ObjectID          string   `json:"object_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+type haState struct {
+	Messages          uint32  `json:"messages"`
+	Bytes             uint64  `json:"bytes"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	LastSeen          string  `json:"last_seen,omitempty"`
+}
+
+/* Remembers which topics already got their discovery config */
+type haDiscovery struct {
+	_mutex    sync.Mutex
+	announced map[string]bool
+}
+
+/* Lowercase, everything but a-z, 0-9 and _ becomes _ */
+func haObjectID(parts ...string) string {
+	joined := strings.ToLower(strings.Join(parts, "_"))
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, joined)
+}
+
+func (d *TopicProc) haStateTopic(objectID string) string {
+	return fmt.Sprintf("%s/%s/state", d.ha.statePrefix(), objectID)
+}
+
+func (d *TopicProc) haConfigs(topic string) map[string]haSensorConfig {
+	objectID := haObjectID(HA_MANUFACTURER, d.friendlyName, topic)
+	device := haDevice{
+		Identifiers:  []string{objectID},
+		Name:         topic,
+		Model:        d.friendlyName,
+		Manufacturer: HA_MANUFACTURER,
+	}
+	stateTopic := d.haStateTopic(objectID)
+
+	configs := map[string]haSensorConfig{
+		"messages": {
+			Name:              "Messages",
+			UnitOfMeasurement: "msg",
+			StateClass:        "measurement",
+			Icon:              "mdi:message-processing",
+			ValueTemplate:     "{{ value_json.messages }}",
+		},
+		"bytes": {
+			Name:              "Bytes",
+			UnitOfMeasurement: "B",
+			DeviceClass:       "data_size",
+			StateClass:        "measurement",
+			ValueTemplate:     "{{ value_json.bytes }}",
+		},
+		"rate": {
+			Name:              fmt.Sprintf("Messages per second (%s)", d.windowNames()[0]),
+			UnitOfMeasurement: "msg/s",
+			StateClass:        "measurement",
+			Icon:              "mdi:speedometer",
+			ValueTemplate:     "{{ value_json.messages_per_second }}",
+		},
+		"last_seen": {
+			Name:          "Last seen",
+			DeviceClass:   "timestamp",
+			ValueTemplate: "{{ value_json.last_seen }}",
+		},
+	}
+
+	for key, cfg := range configs {
+		cfg.UniqueID = objectID + "_" + key
+		cfg.ObjectID = objectID + "_" + key
+		cfg.StateTopic = stateTopic
+		cfg.Device = device
+		configs[key] = cfg
+	}
+	return configs
+}
+
+/* Forget what was announced, e.g. after a reconnect the broker may have lost its retained messages */
+func (d *TopicProc) resetDiscovery() {
+	d._ha._mutex.Lock()
+	defer d._ha._mutex.Unlock()
+	d._ha.announced = make(map[string]bool)
+}
+
+func (d *TopicProc) announceTopic(topic string) error {
+	d._ha._mutex.Lock()
+	defer d._ha._mutex.Unlock()
+
+	if d._ha.announced[topic] {
+		return nil
+	}
+
+	for key, cfg := range d.haConfigs(topic) {
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		configTopic := fmt.Sprintf("%s/sensor/%s/%s/config", d.ha.discoveryPrefix(), cfg.Device.Identifiers[0], key)
+		if err = publishMessage(configTopic, b, true); err != nil {
+			return err
+		}
+	}
+
+	if d._ha.announced == nil {
+		d._ha.announced = make(map[string]bool)
+	}
+	d._ha.announced[topic] = true
+	return nil
+}
+
+/* Announces new topics and publishes the current window of every topic */
+func (d *TopicProc) publishHomeAssistant() error {
+	if !d.ha.Enabled {
+		return nil
+	}
+
+	for _, row := range d.snapshotRows() {
+		if err := d.announceTopic(row.Topic); err != nil {
+			return err
+		}
+
+		state := haState{Messages: row.Messages, Bytes: row.Bytes, MessagesPerSecond: rateOf(row, 0)}
+		if !row.LastSeen.IsZero() {
+			state.LastSeen = row.LastSeen.Format(time.RFC3339)
+		}
+		b, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if err = publishMessage(d.haStateTopic(haObjectID(HA_MANUFACTURER, d.friendlyName, row.Topic)), b, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
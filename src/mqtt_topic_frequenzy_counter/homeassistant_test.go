@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHaObjectID(t *testing.T) {
+	cases := []struct {
+		parts []string
+		id    string
+	}{
+		{[]string{"mqtt_topic_freq", "zigbee", "zigbee2mqtt/Kitchen"}, "mqtt_topic_freq_zigbee_zigbee2mqtt_kitchen"},
+		{[]string{"From Zigbee Network", "a/+/#"}, "from_zigbee_network_a____"},
+		{[]string{"t", "sensor/Wohnzimmer-Lüftung.temp"}, "t_sensor_wohnzimmer_l_ftung_temp"},
+		{[]string{"t", ""}, "t_"},
+	}
+	for _, c := range cases {
+		if got := haObjectID(c.parts...); got != c.id {
+			t.Errorf("haObjectID(%q) = %q, expected %q", c.parts, got, c.id)
+		}
+	}
+}
+
+func TestHaConfigs(t *testing.T) {
+	tp := newTestTopicProc(t, SettingsTopicEntry{FriendlyName: "From Zigbee", Topic: "zigbee2mqtt/#"}, t.TempDir())
+	tp.ha = SettingsHomeAssistant{Enabled: true, StatePrefix: "mtf"}
+
+	const objectID = "mqtt_topic_freq_from_zigbee_zigbee2mqtt_living_room"
+	configs := tp.haConfigs("zigbee2mqtt/Living Room")
+	want := map[string]string{
+		"messages":  "{{ value_json.messages }}",
+		"bytes":     "{{ value_json.bytes }}",
+		"rate":      "{{ value_json.messages_per_second }}",
+		"last_seen": "{{ value_json.last_seen }}",
+	}
+	if len(configs) != len(want) {
+		t.Errorf("%d sensors, expected %d", len(configs), len(want))
+	}
+	for key, template := range want {
+		cfg, found := configs[key]
+		if !found {
+			t.Errorf("no %s sensor", key)
+			continue
+		}
+		if cfg.UniqueID != objectID+"_"+key || cfg.ObjectID != cfg.UniqueID || cfg.ValueTemplate != template {
+			t.Errorf("%s: unique_id %q, object_id %q, value_template %q", key, cfg.UniqueID, cfg.ObjectID, cfg.ValueTemplate)
+		}
+		if cfg.StateTopic != "mtf/"+objectID+"/state" {
+			t.Errorf("%s: state_topic %q", key, cfg.StateTopic)
+		}
+		if len(cfg.Device.Identifiers) != 1 || cfg.Device.Identifiers[0] != objectID || cfg.Device.Name != "zigbee2mqtt/Living Room" || cfg.Device.Model != "From Zigbee" {
+			t.Errorf("%s: device %+v", key, cfg.Device)
+		}
+	}
+	if name := configs["rate"].Name; !strings.Contains(name, "("+DEFAULT_WINDOWS[0]+")") {
+		t.Errorf("rate sensor %q doesn't name its window", name)
+	}
+
+	// the discovery payload as home assistant reads it
+	b, err := json.Marshal(configs["bytes"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]any
+	if err = json.Unmarshal(b, &payload); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range map[string]any{
+		"unit_of_measurement": "B",
+		"device_class":        "data_size",
+		"state_class":         "measurement",
+		"object_id":           objectID + "_bytes",
+	} {
+		if payload[key] != val {
+			t.Errorf("%s = %v, expected %v", key, payload[key], val)
+		}
+	}
+	if _, found := payload["icon"]; found {
+		t.Error("an empty icon is in the payload")
+	}
+	if device, ok := payload["device"].(map[string]any); !ok || device["manufacturer"] != HA_MANUFACTURER {
+		t.Errorf("device %v", payload["device"])
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mqtt_topics</title></head>
+<body>
+<h1>mqtt_topics</h1>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Base topic</th><th>Topics</th><th></th><th></th></tr>
+{{range .}}<tr>
+<td>{{.Name}}</td><td>{{.BaseTopic}}</td><td>{{.Topics}}</td>
+<td><a href="/table/{{.Path}}">table</a></td><td>chart{{$path := .Path}}{{range .Resolutions}} <a href="/chart/{{$path}}?res={{.}}">{{.}}</a>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+var tableTemplate = template.Must(template.New("table").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta http-equiv="refresh" content="{{.Refresh}}"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<p><a href="/">index</a> | <a href="/chart/{{.Path}}">chart</a> | {{.Now}}</p>
+<table border="1" cellpadding="4">
+<tr>{{range .Columns}}<th><a href="?sort={{.Key}}{{if .Asc}}&amp;order=asc{{end}}">{{.Title}}</a></th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Topic}}</td><td>{{.Messages}}</td><td>{{.Bytes}}</td><td>{{.TotalMessages}}</td><td>{{.TotalBytes}}</td><td>{{if not .LastSeen.IsZero}}{{.LastSeen.Format "2006-01-02 15:04:05"}}{{end}}</td>{{range .Rates}}<td>{{printf "%.3f" .MessagesPerSecond}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+/* Path is the escaped name, names of unnamed entries are topics with / & # */
+type indexEntry struct {
+	Name        string
+	Path        string
+	BaseTopic   string
+	Topics      int
+	Resolutions []string
+}
+
+type tableColumn struct {
+	Key   string
+	Title string
+	Asc   bool
+}
+
+type tablePage struct {
+	Name    string
+	Path    string
+	Now     string
+	Refresh int
+	Columns []tableColumn
+	Rows    []topicRow
+}
+
+func findTopicProc(name string) *TopicProc {
+	for _, tp := range currentTopicProcs() {
+		if tp.friendlyName == name {
+			return tp
+		}
+	}
+	return nil
+}
+
+/* Sorts rows by the given column, unknown columns sort by messages */
+func sortTopicRows(rows []topicRow, column string, asc bool) {
+	less := func(i, j int) bool { return rows[i].Messages < rows[j].Messages }
+	switch column {
+	case "topic":
+		less = func(i, j int) bool { return rows[i].Topic < rows[j].Topic }
+	case "bytes":
+		less = func(i, j int) bool { return rows[i].Bytes < rows[j].Bytes }
+	case "total":
+		less = func(i, j int) bool { return rows[i].TotalMessages < rows[j].TotalMessages }
+	case "total_bytes":
+		less = func(i, j int) bool { return rows[i].TotalBytes < rows[j].TotalBytes }
+	case "last_seen":
+		less = func(i, j int) bool { return rows[i].LastSeen.Before(rows[j].LastSeen) }
+	}
+	// rate_N sorts by the messages per second of the Nth window
+	if n, found := strings.CutPrefix(column, "rate_"); found {
+		if w, err := strconv.Atoi(n); err == nil && w >= 0 {
+			less = func(i, j int) bool { return rateOf(rows[i], w) < rateOf(rows[j], w) }
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if asc {
+			return less(i, j)
+		}
+		return less(j, i)
+	})
+}
+
+func rateOf(row topicRow, window int) float64 {
+	if window >= len(row.Rates) {
+		return 0
+	}
+	return row.Rates[window].MessagesPerSecond
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	entries := make([]indexEntry, 0)
+	for _, tp := range currentTopicProcs() {
+		entries = append(entries, indexEntry{
+			Name:        tp.friendlyName,
+			Path:        url.PathEscape(tp.friendlyName),
+			BaseTopic:   tp.baseTopic,
+			Topics:      len(tp.snapshotRows()),
+			Resolutions: tp.chart.resolutions(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, entries); err != nil {
+		ErrorLogger.Println(err)
+	}
+}
+
+func handleChart(w http.ResponseWriter, r *http.Request) {
+	tp := findTopicProc(r.PathValue("name"))
+	if tp == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// ?res= picks one of the retention resolutions
+	resolution := r.URL.Query().Get("res")
+	if len(resolution) > 0 && tp.chart.tier(resolution) == nil {
+		http.Error(w, fmt.Sprintf("unknown resolution, use one of %s", strings.Join(tp.chart.resolutions(), ", ")), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tp.renderChart(w, resolution); err != nil {
+		ErrorLogger.Println(err)
+	}
+}
+
+func handleTable(w http.ResponseWriter, r *http.Request) {
+	tp := findTopicProc(r.PathValue("name"))
+	if tp == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	column := r.URL.Query().Get("sort")
+	asc := strings.EqualFold(r.URL.Query().Get("order"), "asc")
+
+	rows := tp.snapshotRows()
+	sortTopicRows(rows, column, asc)
+
+	page := tablePage{
+		Name:    tp.friendlyName,
+		Path:    url.PathEscape(tp.friendlyName),
+		Now:     clock.Now().Format(time.RFC3339),
+		Refresh: 5,
+		Rows:    rows,
+	}
+	for _, c := range []tableColumn{
+		{Key: "topic", Title: "Topic"},
+		{Key: "messages", Title: "Messages"},
+		{Key: "bytes", Title: "Bytes"},
+		{Key: "total", Title: "Messages (alltime)"},
+		{Key: "total_bytes", Title: "Bytes (alltime)"},
+		{Key: "last_seen", Title: "Last seen"},
+	} {
+		page.Columns = append(page.Columns, c)
+	}
+	for idx, name := range tp.windowNames() {
+		page.Columns = append(page.Columns, tableColumn{Key: fmt.Sprintf("rate_%d", idx), Title: fmt.Sprintf("msg/s (%s)", name)})
+	}
+	for idx := range page.Columns {
+		// clicking the active column again flips the order
+		page.Columns[idx].Asc = page.Columns[idx].Key == column && !asc
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tableTemplate.Execute(w, page); err != nil {
+		ErrorLogger.Println(err)
+	}
+}
+
+func newHttpMux(settings SettingsHttp) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", newMetricsExporter(settings.MetricsMaxSeries))
+	mux.HandleFunc("GET /{$}", handleIndex)
+	// the rest of the path, the links escape / but typed urls may not
+	mux.HandleFunc("GET /chart/{name...}", handleChart)
+	mux.HandleFunc("GET /table/{name...}", handleTable)
+	registerAPI(mux, settings)
+	mux.HandleFunc("GET /api/stream", handleStream)
+	return mux
+}
+
+/* Starts the http server in the background, returns nil if it is disabled */
+func startHttpServer(settings SettingsHttp) *http.Server {
+	if len(settings.Listen) == 0 {
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:              settings.Listen,
+		Handler:           newHttpMux(settings),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	srv.RegisterOnShutdown(eventHub.close)
+
+	go func() {
+		InfoLogger.Printf("HTTP: listening on %s\n", settings.Listen)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			ErrorLogger.Printf("HTTP: %s\n", err)
+		}
+	}()
+	return srv
+}
+
+func stopHttpServer(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		ErrorLogger.Printf("HTTP: %s\n", err)
+	}
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/go-co-op/gocron/v2"
+	"github.com/jonboulle/clockwork"
 )
 
 var topicProcs []*TopicProc
@@ -22,30 +26,73 @@ var (
 	ErrorLogger   *log.Logger
 )
 
-func doSubscribe(ctx context.Context, cm *autopaho.ConnectionManager, prop *paho.ConnackProperties) {
-	for _, entry := range topicProcs {
-
-		subprop := new(paho.SubscribeProperties)
+func subscribeFilter(ctx context.Context, cm *autopaho.ConnectionManager, filter string, subID int, prop *paho.ConnackProperties) {
+	subprop := new(paho.SubscribeProperties)
+	if subID > 0 {
 		subprop.SubscriptionIdentifier = new(int)
-		*subprop.SubscriptionIdentifier = entry.subID
+		*subprop.SubscriptionIdentifier = subID
+	}
+	if prop != nil {
 		subprop.User = prop.User
+	}
 
-		subopt := []paho.SubscribeOptions{
-			{
-				Topic: entry.baseTopic,
-				QoS:   0,
-			},
-		}
+	subopt := []paho.SubscribeOptions{
+		{
+			Topic: filter,
+			QoS:   0,
+		},
+	}
+
+	subscribe := new(paho.Subscribe)
+	subscribe.Subscriptions = subopt
+	subscribe.Properties = subprop
+
+	ack, err := cm.Subscribe(ctx, subscribe)
+	if err == nil {
+		InfoLogger.Printf("Subcribe sucess: %#v", ack)
+	} else {
+		ErrorLogger.Println(err)
+	}
+}
+
+func unsubscribeFilter(ctx context.Context, cm *autopaho.ConnectionManager, filter string) {
+	ack, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{filter}})
+	if err == nil {
+		InfoLogger.Printf("Unsubcribe sucess: %#v", ack)
+	} else {
+		ErrorLogger.Println(err)
+	}
+}
+
+func doSubscribe(ctx context.Context, cm *autopaho.ConnectionManager, routing string, prop *paho.ConnackProperties) {
+	selectRouting(routing, prop)
 
-		subscribe := new(paho.Subscribe)
-		subscribe.Subscriptions = subopt
-		subscribe.Properties = subprop
+	procs := currentTopicProcs()
+	filters := make([]string, 0, len(procs))
+	for _, entry := range procs {
+		filters = append(filters, entry.baseTopic)
+	}
+
+	if subIDRouting.Load() && len(minimalFilterSet(filters)) < len(filters) {
+		// paho only hands us one subscription identifier per message
+		WarningLogger.Println("Topics of some entries overlap, messages may only be counted once. Consider routing: topic")
+	}
+	for filter, subID := range wantedSubscriptions(procs) {
+		subscribeFilter(ctx, cm, filter, subID, prop)
+	}
+}
 
-		ack, err := cm.Subscribe(ctx, subscribe)
-		if err == nil {
-			InfoLogger.Printf("Subcribe sucess: %#v", ack)
-		} else {
-			ErrorLogger.Println(err)
+/* Brings the subscriptions of a running connection from before to after, see wantedSubscriptions */
+func updateSubscriptions(ctx context.Context, cm *autopaho.ConnectionManager, before map[string]int, after map[string]int) {
+	for filter := range before {
+		if _, found := after[filter]; !found {
+			unsubscribeFilter(ctx, cm, filter)
+		}
+	}
+	for filter, subID := range after {
+		// subscribing again replaces the subscription identifier
+		if prev, found := before[filter]; !found || prev != subID {
+			subscribeFilter(ctx, cm, filter, subID, nil)
 		}
 	}
 }
@@ -85,6 +132,14 @@ func setupMqtt(args ParsedArgs, settings *SettingsStruct, ctx context.Context) (
 		return nil, err
 	}
 
+	tlsCfg, err := settings.Tls.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil && tlsCfg.InsecureSkipVerify {
+		WarningLogger.Println("TLS: certificate verification of the broker is disabled!")
+	}
+
 	cliCfg := autopaho.ClientConfig{
 		//Debug:           InfoLogger,
 		//PahoDebug:       InfoLogger,
@@ -93,6 +148,7 @@ func setupMqtt(args ParsedArgs, settings *SettingsStruct, ctx context.Context) (
 		ConnectUsername: user,
 		ConnectPassword: []byte(passwd),
 		ServerUrls:      []*url.URL{u},
+		TlsCfg:          tlsCfg,
 		KeepAlive:       20, // Keepalive message should be sent every 20 seconds
 		// CleanStartOnInitialConnection defaults to false. Setting this to true will clear the session on the first connection.
 		CleanStartOnInitialConnection: false,
@@ -103,9 +159,12 @@ func setupMqtt(args ParsedArgs, settings *SettingsStruct, ctx context.Context) (
 		SessionExpiryInterval: 3600,
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 			InfoLogger.Println("mqtt connection up")
+			for _, tp := range currentTopicProcs() {
+				tp.resetDiscovery()
+			}
 			// Subscribing in the OnConnectionUp callback is recommended (ensures the subscription is reestablished if
 			// the connection drops)
-			doSubscribe(ctx, cm, connAck.Properties)
+			doSubscribe(ctx, cm, settings.Routing, connAck.Properties)
 			InfoLogger.Println("mqtt subscription made")
 		},
 		OnConnectError: func(err error) { ErrorLogger.Printf("error whilst attempting connection: %s\n", err) },
@@ -117,17 +176,15 @@ func setupMqtt(args ParsedArgs, settings *SettingsStruct, ctx context.Context) (
 			// You can write the function(s) yourself or use the supplied Router
 			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
 				func(pr paho.PublishReceived) (bool, error) {
-					found := false
-
-					for _, val := range topicProcs {
-						if val.subID == *pr.Packet.Properties.SubscriptionIdentifier {
-							found = true
-							val.process(pr.Packet.Topic)
-						}
+					if recorder != nil {
+						recorder.write(clock.Now(), pr.Packet)
 					}
-
-					if !found {
-						ErrorLogger.Printf("%s with subid: %d was not found in my list OoO", pr.Packet.Topic, *pr.Packet.Properties.SubscriptionIdentifier)
+					control := isControlMessage(pr.Packet)
+					if control {
+						go handleControlMessage(pr.Packet)
+					}
+					if !routePublish(pr.Packet) && !control {
+						ErrorLogger.Printf("%s was not found in my list OoO", pr.Packet.Topic)
 						return false, nil
 					}
 
@@ -144,6 +201,12 @@ func setupMqtt(args ParsedArgs, settings *SettingsStruct, ctx context.Context) (
 		},
 	}
 
+	// top only looks for a moment, it leaves no session behind
+	if args.command == COMMAND_TOP {
+		cliCfg.CleanStartOnInitialConnection = true
+		cliCfg.SessionExpiryInterval = 0
+	}
+
 	c, err := autopaho.NewConnection(ctx, cliCfg) // starts process; will reconnect until context cancelled
 	if err != nil {
 		ErrorLogger.Panicln(err)
@@ -162,52 +225,140 @@ func main() {
 	WarningLogger = log.New(os.Stdout, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
 	ErrorLogger = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
 
-	scheduler, err := gocron.NewScheduler()
+	args, err := checkCmdArgs(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		ErrorLogger.Panicln(err)
+		ErrorLogger.Println(err)
+		os.Exit(2)
 	}
 
-	scheduler.Start()
+	switch args.command {
+	case COMMAND_REPORT:
+		os.Exit(runReport(args.rest))
+	case COMMAND_DIFF:
+		os.Exit(runDiff(args.rest))
+	case COMMAND_VALIDATE, COMMAND_VALIDATE_CONFIG:
+		os.Exit(runValidateConfig(args.command, args.rest))
+	case COMMAND_TOP:
+		os.Exit(runTop(args.rest))
+	}
 
-	var args ParsedArgs
-	args, err = checkCmdArgs()
+	// A replay runs on the captures time, the scheduler has to follow it
+	var replay *captureReader
+	var fake clockwork.FakeClock
+	schedOptions := []gocron.SchedulerOption{}
+	if len(args.replay) > 0 {
+		var replayFile *os.File
+		replayFile, replay, err = openReplay(args.replay)
+		if err != nil {
+			ErrorLogger.Printf("Opening capture %s failed: %s\n", args.replay, err)
+			return
+		}
+		defer replayFile.Close()
+		fake = clockwork.NewFakeClockAt(replay.now())
+		clock = fake
+		replaying = true
+		schedOptions = append(schedOptions, replaySchedulerOption())
+	}
+
+	scheduler, err := gocron.NewScheduler(append(schedOptions, gocron.WithClock(clock))...)
 	if err != nil {
-		WarningLogger.Println(err)
-		return
+		ErrorLogger.Panicln(err)
 	}
 
+	scheduler.Start()
+
 	settings, serr := loadSettings(args.settings, true, InfoLogger)
-	if serr != nil {
-		WarningLogger.Println(err)
+	if errors.Is(serr, os.ErrNotExist) && len(args.settings) == 0 && len(args.topics) > 0 {
+		WarningLogger.Println(serr)
+	} else if serr != nil {
+		ErrorLogger.Printf("Invalid settings: %s\n", serr)
+		os.Exit(1)
+	}
+
+	settings.Topics = append(settings.Topics, args.topicEntries()...)
+	if len(settings.Topics) == 0 {
+		ErrorLogger.Println("Nothing to watch, configure topics or use --topic")
+		os.Exit(2)
 	}
 
 	fman := fileman{
 		working_directory: getBetterStringNoErr(args.path, settings.Path),
 	}
+	// The files of a replay never go to the path of the settings, the live instance owns those
+	if replaying {
+		fman.working_directory = args.path
+		if err := os.MkdirAll(fman.working_directory, 0o755); err != nil {
+			ErrorLogger.Printf("Creating %s failed: %s\n", fman.working_directory, err)
+			os.Exit(1)
+		}
+		InfoLogger.Printf("Replay files go to %s\n", fman.working_directory)
+	}
 
-	for idx, entry := range settings.Topics {
-		tp, err := NewTopicProc(entry, scheduler, InfoLogger)
+	rules, err := compileRules(settings)
+	if err != nil {
+		ErrorLogger.Printf("Invalid settings: %s\n", err)
+		return
+	}
+
+	for _, entry := range settings.Topics {
+		tp, err := setupTopicProc(entry, settings, rules, scheduler, &fman)
 		if err != nil {
-			ErrorLogger.Printf("Setting up TopicProc for %s (%s) failed: %#v\n", entry.Topic, entry.FriendlyName, err)
-			continue
+			ErrorLogger.Printf("Setting up TopicProc for %s (%s) failed: %s\n", entry.Topic, entry.FriendlyName, err)
+			os.Exit(1)
 		}
 
-		tp.subID = idx + 1
-		tp.fman = &fman
+		tp.subID = _takeSubID()
 		topicProcs = append(topicProcs, tp)
 	}
 
 	// App will run until cancelled by user (e.g. ctrl-c)
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+
+	topicSupervisor = &supervisor{ctx: ctx, args: args, settings: settings, rules: rules, sched: scheduler, fman: &fman}
+	controlSettings = settings.Control
+
+	// A replay would answer on the port of the live instance, its stream tickers would also wait on the fake clock
+	var httpSrv *http.Server
+	if replaying {
+		InfoLogger.Println("HTTP: not started during a replay")
+	} else {
+		httpSrv = startHttpServer(settings.Http)
+	}
+	done := make(chan bool, 2)
 	var conn *autopaho.ConnectionManager
-	conn, err = setupMqtt(args, settings, ctx)
+	if replay != nil {
+		InfoLogger.Printf("Replaying %s from %s, speed %g\n", args.replay, replay.now().Format(time.RFC3339), args.speed)
+		go func() {
+			count, err := runReplay(ctx, replay, fake, scheduler, args.speed)
+			if err != nil {
+				ErrorLogger.Printf("Replay stopped: %s\n", err)
+			}
+			InfoLogger.Printf("Replayed %d messages up to %s\n", count, clock.Now().Format(time.RFC3339))
+			done <- true
+		}()
+	} else {
+		if len(args.record) > 0 {
+			recorder, err = newCaptureWriter(args.record, args.recordPayload, clock.Now())
+			if err != nil {
+				ErrorLogger.Printf("Creating capture %s failed: %s\n", args.record, err)
+				return
+			}
+			InfoLogger.Printf("Recording to %s\n", args.record)
+		}
 
-	if err != nil {
-		ErrorLogger.Panicln(err)
+		conn, err = setupMqtt(args, settings, ctx)
+
+		if err != nil {
+			ErrorLogger.Panicln(err)
+		}
+		mqttConn.Store(conn)
 	}
 
-	if args.graph != 0 {
+	if args.graph {
 		InfoLogger.Println("Graph gneration enabled, you can send SIGUSR1 to process to write graph and beginn new session")
 		usr1 := make(chan os.Signal, 1)
 		signal.Notify(usr1, syscall.SIGUSR1)
@@ -215,7 +366,7 @@ func main() {
 			for {
 				su := <-usr1
 				InfoLogger.Printf("[GOT: %s] OK, gen graph & reset...\n", su.String())
-				for _, tp := range topicProcs {
+				for _, tp := range currentTopicProcs() {
 					tp.writeToJsonFile(false)
 					tp.writeStatsConsole()
 					tp.writeGraph()
@@ -225,13 +376,19 @@ func main() {
 		}()
 	}
 
-	if args.repr {
-		InfoLogger.Println("repr found skipping go routine printStats")
-	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			InfoLogger.Println("[GOT: SIGHUP] Reloading settings...")
+			if err := topicSupervisor.reload(); err != nil {
+				ErrorLogger.Printf("Reload failed, keeping the running settings: %s\n", err)
+			}
+		}
+	}()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	done := make(chan bool, 1)
 	go func() {
 		sig := <-sigs
 		InfoLogger.Println()
@@ -243,17 +400,35 @@ func main() {
 	InfoLogger.Println("exiting")
 
 	InfoLogger.Println("signal caught - exiting")
-	<-conn.Done() // Wait for clean shutdown (cancelling the context triggered the shutdown)
+	if conn != nil {
+		<-conn.Done() // Wait for clean shutdown (cancelling the context triggered the shutdown)
+	}
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			ErrorLogger.Printf("Closing capture failed: %s\n", err)
+		}
+	}
+
+	stopHttpServer(httpSrv)
 
 	scheduler.Shutdown()
+	signal.Stop(hup)
+	procs := currentTopicProcs()
 
 	InfoLogger.Println("Writing alltime stats...")
-	for _, tp := range topicProcs {
+	for _, tp := range procs {
 		tp.writeToJsonFile(true)
 	}
 
+	InfoLogger.Println("Writing state...")
+	for _, tp := range procs {
+		if err := tp.saveState(); err != nil {
+			ErrorLogger.Printf("Saving state for %s failed: %s\n", tp.friendlyName, err)
+		}
+	}
+
 	InfoLogger.Println("Writing charts...")
-	for _, tp := range topicProcs {
+	for _, tp := range procs {
 		tp.writeGraph()
 	}
 	InfoLogger.Println("Bye!")
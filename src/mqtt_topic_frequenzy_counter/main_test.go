@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/jonboulle/clockwork"
+)
+
+func TestMain(m *testing.M) {
+	InfoLogger = log.New(io.Discard, "INFO: ", 0)
+	WarningLogger = log.New(io.Discard, "WARNING: ", 0)
+	ErrorLogger = log.New(io.Discard, "ERROR: ", 0)
+	os.Exit(m.Run())
+}
+
+/* Swaps the global clock for a fake one at, the real one is back after the test */
+func useFakeClock(t *testing.T, at time.Time) clockwork.FakeClock {
+	t.Helper()
+	fake := clockwork.NewFakeClockAt(at)
+	real := clock
+	clock = fake
+	t.Cleanup(func() { clock = real })
+	return fake
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/* A TopicProc with its files in dir, its jobs are never run */
+func newTestTopicProc(t *testing.T, entry SettingsTopicEntry, dir string) *TopicProc {
+	t.Helper()
+	sched, err := gocron.NewScheduler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sched.Shutdown() })
+	tp, err := NewTopicProc(entry, sched, &fileman{working_directory: dir}, InfoLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tp
+}
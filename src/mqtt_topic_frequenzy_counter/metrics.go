@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const METRICS_OVERFLOW_TOPIC = "__other__"
+
+type metricsSeriesKey struct {
+	friendlyName string
+	topic        string
+}
+
+/*
+Exposes topicStoreTotal in the prometheus text format.
+With maxSeries > 0 only the first maxSeries topics get their own series,
+everything else is summed up in a topic="__other__" series. Admitted topics
+are never dropped again, so every exported series stays monotonic.
+*/
+type metricsExporter struct {
+	_mutex    sync.Mutex
+	maxSeries int
+	admitted  map[metricsSeriesKey]bool
+}
+
+func newMetricsExporter(maxSeries int) *metricsExporter {
+	return &metricsExporter{
+		maxSeries: maxSeries,
+		admitted:  make(map[metricsSeriesKey]bool),
+	}
+}
+
+type metricsSample struct {
+	friendlyName string
+	baseTopic    string
+	topic        string
+	messages     uint64
+	bytes        uint64
+	rates        []windowRate
+	windows      []string
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (s metricsSample) labels() string {
+	return fmt.Sprintf(`friendly_name="%s",base_topic="%s",topic="%s"`,
+		escapeLabelValue(s.friendlyName), escapeLabelValue(s.baseTopic), escapeLabelValue(s.topic))
+}
+
+/* Internal function, expects _mutex to be held */
+func (m *metricsExporter) _admit(key metricsSeriesKey) bool {
+	if m.admitted[key] {
+		return true
+	}
+	if m.maxSeries > 0 && len(m.admitted) >= m.maxSeries {
+		return false
+	}
+	m.admitted[key] = true
+	return true
+}
+
+func (m *metricsExporter) collect(procs []*TopicProc) ([]metricsSample, int) {
+	m._mutex.Lock()
+	defer m._mutex.Unlock()
+
+	samples := make([]metricsSample, 0)
+	dropped := 0
+	for _, tp := range procs {
+		rows := tp.snapshotRows()
+		// admit in a stable order, so a restart admits the same topics again
+		sortTopicRows(rows, "topic", true)
+
+		other := metricsSample{
+			friendlyName: tp.friendlyName,
+			baseTopic:    tp.baseTopic,
+			topic:        METRICS_OVERFLOW_TOPIC,
+			rates:        make([]windowRate, len(tp.windowNames())),
+			windows:      tp.windowNames(),
+		}
+		hasOther := false
+		for _, row := range rows {
+			if m._admit(metricsSeriesKey{friendlyName: tp.friendlyName, topic: row.Topic}) {
+				samples = append(samples, metricsSample{
+					friendlyName: tp.friendlyName,
+					baseTopic:    tp.baseTopic,
+					topic:        row.Topic,
+					messages:     uint64(row.TotalMessages),
+					bytes:        row.TotalBytes,
+					rates:        row.Rates,
+					windows:      tp.windowNames(),
+				})
+				continue
+			}
+			hasOther = true
+			dropped++
+			other.messages += uint64(row.TotalMessages)
+			other.bytes += row.TotalBytes
+			for idx, rate := range row.Rates {
+				other.rates[idx].MessagesPerSecond += rate.MessagesPerSecond
+				other.rates[idx].BytesPerSecond += rate.BytesPerSecond
+			}
+		}
+		if hasOther {
+			samples = append(samples, other)
+		}
+	}
+	return samples, dropped
+}
+
+func (m *metricsExporter) write(writer io.Writer, procs []*TopicProc) error {
+	samples, dropped := m.collect(procs)
+	sort.SliceStable(samples, func(i, j int) bool {
+		if samples[i].friendlyName != samples[j].friendlyName {
+			return samples[i].friendlyName < samples[j].friendlyName
+		}
+		return samples[i].topic < samples[j].topic
+	})
+
+	var sb strings.Builder
+	sb.WriteString("# HELP mqtt_topic_messages_total Messages received on a topic.\n")
+	sb.WriteString("# TYPE mqtt_topic_messages_total counter\n")
+	for _, s := range samples {
+		sb.WriteString(fmt.Sprintf("mqtt_topic_messages_total{%s} %d\n", s.labels(), s.messages))
+	}
+	sb.WriteString("# HELP mqtt_topic_bytes_total Payload bytes received on a topic.\n")
+	sb.WriteString("# TYPE mqtt_topic_bytes_total counter\n")
+	for _, s := range samples {
+		sb.WriteString(fmt.Sprintf("mqtt_topic_bytes_total{%s} %d\n", s.labels(), s.bytes))
+	}
+	sb.WriteString("# HELP mqtt_topic_messages_per_second Messages per second on a topic within a rolling window.\n")
+	sb.WriteString("# TYPE mqtt_topic_messages_per_second gauge\n")
+	for _, s := range samples {
+		for idx, rate := range s.rates {
+			sb.WriteString(fmt.Sprintf("mqtt_topic_messages_per_second{%s,window=\"%s\"} %g\n", s.labels(), escapeLabelValue(s.windows[idx]), rate.MessagesPerSecond))
+		}
+	}
+	sb.WriteString("# HELP mqtt_topic_bytes_per_second Payload bytes per second on a topic within a rolling window.\n")
+	sb.WriteString("# TYPE mqtt_topic_bytes_per_second gauge\n")
+	for _, s := range samples {
+		for idx, rate := range s.rates {
+			sb.WriteString(fmt.Sprintf("mqtt_topic_bytes_per_second{%s,window=\"%s\"} %g\n", s.labels(), escapeLabelValue(s.windows[idx]), rate.BytesPerSecond))
+		}
+	}
+	sb.WriteString("# HELP mqtt_topic_series_dropped Topics summed up in the __other__ series due to metrics_max_series.\n")
+	sb.WriteString("# TYPE mqtt_topic_series_dropped gauge\n")
+	sb.WriteString(fmt.Sprintf("mqtt_topic_series_dropped %d\n", dropped))
+
+	_, err := io.WriteString(writer, sb.String())
+	return err
+}
+
+func (m *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.write(w, currentTopicProcs()); err != nil {
+		ErrorLogger.Println(err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMaxSeries(t *testing.T) {
+	tp := newTestTopicProc(t, SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"}, t.TempDir())
+	// a/n gets n messages of 10 bytes
+	for n := 1; n <= 6; n++ {
+		for i := 0; i < n; i++ {
+			tp.process(fmt.Sprintf("a/%d", n), 10)
+		}
+	}
+	m := newMetricsExporter(3)
+
+	check := func(wantOther uint64, wantDropped int) {
+		t.Helper()
+		samples, dropped := m.collect([]*TopicProc{tp})
+		series := 0
+		var other *metricsSample
+		for i, s := range samples {
+			if s.topic == METRICS_OVERFLOW_TOPIC {
+				other = &samples[i]
+				continue
+			}
+			series++
+			if s.topic != "a/1" && s.topic != "a/2" && s.topic != "a/3" {
+				t.Errorf("%s got a series, the first three were admitted", s.topic)
+			}
+		}
+		if series != 3 || dropped != wantDropped {
+			t.Errorf("%d series & %d dropped, expected 3 & %d", series, dropped, wantDropped)
+		}
+		if other == nil || other.messages != wantOther || other.bytes != 10*wantOther {
+			t.Fatalf("%s holds %+v, expected %d messages", METRICS_OVERFLOW_TOPIC, other, wantOther)
+		}
+		rates := make([]windowRate, len(tp.windowNames()))
+		rows := tp.snapshotRows()
+		// summed up in the same order, floats
+		sortTopicRows(rows, "topic", true)
+		for _, row := range rows {
+			if !m.admitted[metricsSeriesKey{friendlyName: "t", topic: row.Topic}] {
+				for idx, rate := range row.Rates {
+					rates[idx].MessagesPerSecond += rate.MessagesPerSecond
+					rates[idx].BytesPerSecond += rate.BytesPerSecond
+				}
+			}
+		}
+		if !slices.Equal(other.rates, rates) || rates[0].MessagesPerSecond == 0 {
+			t.Errorf("%s rates %v, expected the sum %v", METRICS_OVERFLOW_TOPIC, other.rates, rates)
+		}
+	}
+	check(4+5+6, 3)
+
+	// a topic sorting first still comes after the admitted ones
+	tp.process("a/0", 10)
+	check(1+4+5+6, 4)
+
+	var sb strings.Builder
+	if err := m.write(&sb, []*TopicProc{tp}); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+	if n := strings.Count(out, "mqtt_topic_messages_total{"); n != 4 {
+		t.Errorf("%d mqtt_topic_messages_total series, expected 3 & %s", n, METRICS_OVERFLOW_TOPIC)
+	}
+	for _, line := range []string{
+		`mqtt_topic_messages_total{friendly_name="t",base_topic="a/#",topic="__other__"} 16`,
+		"mqtt_topic_series_dropped 4",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+/* The live broker connection, nil until setupMqtt is done */
+var mqttConn atomic.Pointer[autopaho.ConnectionManager]
+
+func publishMessage(topic string, payload []byte, retain bool) error {
+	return publishPacket(&paho.Publish{
+		Topic:   topic,
+		QoS:     1,
+		Retain:  retain,
+		Payload: payload,
+	})
+}
+
+func publishPacket(p *paho.Publish) error {
+	cm := mqttConn.Load()
+	if cm == nil {
+		return errors.New("MQTT: not connected, can't publish")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := cm.Publish(ctx, p)
+	return err
+}
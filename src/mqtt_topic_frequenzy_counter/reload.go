@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+/* Guards topicProcs & nextSubID, a reload swaps entries while messages are routed */
+var topicProcsMutex sync.RWMutex
+
+/* Subscription identifiers are never reused, late messages of a removed entry must not end up in a new one */
+var nextSubID = 1
+
+/* Copy of the running TopicProcs, safe to iterate while a reload happens */
+func currentTopicProcs() []*TopicProc {
+	topicProcsMutex.RLock()
+	defer topicProcsMutex.RUnlock()
+	return slices.Clone(topicProcs)
+}
+
+/* Concurrent unsafe, hold topicProcsMutex */
+func _takeSubID() int {
+	id := nextSubID
+	nextSubID++
+	return id
+}
+
+/* Creates the TopicProc of entry with what it needs from the global settings, subID is left to the caller */
+func setupTopicProc(entry SettingsTopicEntry, settings *SettingsStruct, rules []*alertRule, sched gocron.Scheduler, fman *fileman) (*TopicProc, error) {
+	tp, err := NewTopicProc(entry, sched, fman, InfoLogger)
+	if err != nil {
+		return nil, err
+	}
+	tp.notify = settings.Alerts
+	tp._rules = newRuleEngine(rules, tp.friendlyName)
+	tp.ha = settings.HomeAssistant
+	return tp, nil
+}
+
+/* Removes the jobs of the TopicProc, it won't write anything on its own afterwards */
+func (d *TopicProc) stop(sched gocron.Scheduler) {
+	for _, job := range []gocron.Job{d._job_chart, d._job_json, d._job_reset, d._job_state, d._job_silence, d._job_sample} {
+		if job == nil {
+			continue
+		}
+		if err := sched.RemoveJob(job.ID()); err != nil {
+			d._log.Printf("Removing job %s of %s failed: %s\n", job.ID(), d.friendlyName, err)
+		}
+	}
+}
+
+/*
+Continues the current window of old, only makes sense for the same baseTopic.
+The totals & lastSeen come along too, the saved state misses what arrived after it was written.
+The rolling windows & the chart only if they are set up the same way.
+*/
+func (d *TopicProc) adoptWindow(old *TopicProc) {
+	old._mutex.Lock()
+	defer old._mutex.Unlock()
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	d.topicStore = old.topicStore
+	d.topicBytes = old.topicBytes
+	d.topicStoreTotal = old.topicStoreTotal
+	d.topicBytesTotal = old.topicBytesTotal
+	d.lastSeen = old.lastSeen
+	d.windowStart = old.windowStart
+	d._sample_msgs = old._sample_msgs
+	d._sample_bytes = old._sample_bytes
+	d._snapshot_msgs = old._snapshot_msgs
+	d._snapshot_bytes = old._snapshot_bytes
+	d._snapshot_since = old._snapshot_since
+	if slices.Equal(d._setting.Windows, old._setting.Windows) && d._setting.WindowBucket == old._setting.WindowBucket {
+		d._windows = old._windows
+	}
+	if reflect.DeepEqual(d._setting.Retention, old._setting.Retention) {
+		d.chart.tiers = old.chart.tiers
+	}
+}
+
+/* Settings a reload can't apply, they need a restart */
+func restartOnlyChanges(old *SettingsStruct, updated *SettingsStruct) []string {
+	changed := make([]string, 0)
+	fields := []struct {
+		key          string
+		old, updated any
+	}{
+		{"url", old.Url, updated.Url},
+		{"user", old.User, updated.User},
+		{"password", old.Passwd, updated.Passwd},
+		{"client_id", old.ClientID, updated.ClientID},
+		{"path", old.Path, updated.Path},
+		{"routing", old.Routing, updated.Routing},
+		{"tls", old.Tls, updated.Tls},
+		{"http", old.Http, updated.Http},
+		{"control", old.Control, updated.Control},
+	}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.old, f.updated) {
+			changed = append(changed, f.key)
+		}
+	}
+	return changed
+}
+
+/*
+Owns what TopicProcs are created with, so they can be added & removed at runtime
+by a reload (SIGHUP) or the control topic
+*/
+type supervisor struct {
+	_mutex   sync.Mutex
+	ctx      context.Context
+	args     ParsedArgs
+	settings *SettingsStruct
+	rules    []*alertRule
+	sched    gocron.Scheduler
+	fman     *fileman
+}
+
+/* Set up by main before the connection & http server start */
+var topicSupervisor *supervisor
+
+/*
+Swaps the running TopicProcs & brings the subscriptions along, new ones get a subID.
+update runs under the lock, routing waits until it is done.
+*/
+func (s *supervisor) swapTopicProcs(update func(procs []*TopicProc) []*TopicProc) {
+	topicProcsMutex.Lock()
+	procs := update(slices.Clone(topicProcs))
+	for _, tp := range procs {
+		if tp.subID == 0 {
+			tp.subID = _takeSubID()
+		}
+	}
+	before := wantedSubscriptions(topicProcs)
+	topicProcs = procs
+	after := wantedSubscriptions(topicProcs)
+	topicProcsMutex.Unlock()
+
+	if cm := mqttConn.Load(); cm != nil {
+		updateSubscriptions(s.ctx, cm, before, after)
+	}
+}
+
+/* Writes what a TopicProc writes on shutdown & removes its jobs, it has to be out of topicProcs already */
+func (s *supervisor) retire(tp *TopicProc) {
+	tp.stop(s.sched)
+	tp.writeToJsonFile(true)
+	if err := tp.saveState(); err != nil {
+		ErrorLogger.Printf("Saving state for %s failed: %s\n", tp.friendlyName, err)
+	}
+	tp.writeGraph()
+}
+
+/*
+Applies a changed settings file to the running process.
+Entries are matched by friendly name: unchanged ones keep running untouched,
+changed ones are recreated from their saved state & keep the current window,
+removed ones write their alltime stats & state like on shutdown.
+Nothing changes if the new settings are invalid.
+*/
+func (s *supervisor) reload() error {
+	s._mutex.Lock()
+	defer s._mutex.Unlock()
+
+	settings, err := loadSettings(s.args.settings, false, InfoLogger)
+	if errors.Is(err, os.ErrNotExist) && len(s.args.settings) == 0 && len(s.args.topics) > 0 {
+		WarningLogger.Println(err)
+	} else if err != nil {
+		return err
+	}
+	settings.Topics = append(settings.Topics, s.args.topicEntries()...)
+	if len(settings.Topics) == 0 {
+		return errors.New("nothing to watch")
+	}
+	rules, err := compileRules(settings)
+	if err != nil {
+		return err
+	}
+	if changed := restartOnlyChanges(s.settings, settings); len(changed) > 0 {
+		WarningLogger.Printf("Reload: changes of %v only apply after a restart\n", changed)
+	}
+	rulesChanged := !reflect.DeepEqual(s.settings.Rules, settings.Rules) || !reflect.DeepEqual(s.settings.Alerts, settings.Alerts)
+
+	running := make(map[string]*TopicProc)
+	for _, tp := range currentTopicProcs() {
+		running[tp.friendlyName] = tp
+	}
+
+	procs := make([]*TopicProc, 0, len(settings.Topics))
+	// new TopicProc -> the one it replaces
+	replaced := make(map[*TopicProc]*TopicProc)
+	created := make([]*TopicProc, 0)
+	// undo everything created so far, the old TopicProcs keep running
+	fail := func(err error) error {
+		for _, tp := range created {
+			tp.stop(s.sched)
+		}
+		return err
+	}
+
+	for _, entry := range settings.Topics {
+		name := entry.name()
+		old, found := running[name]
+		if found && reflect.DeepEqual(old._setting, entry) {
+			delete(running, name)
+			old._mutex.Lock()
+			old.notify = settings.Alerts
+			old.ha = settings.HomeAssistant
+			if rulesChanged {
+				old._rules = newRuleEngine(rules, old.friendlyName)
+			}
+			old._mutex.Unlock()
+			procs = append(procs, old)
+			continue
+		}
+
+		if found {
+			// the new one starts from what the old one had
+			if err := old.saveState(); err != nil {
+				return fail(fmt.Errorf("%s: saving state: %w", name, err))
+			}
+		}
+		tp, err := setupTopicProc(entry, settings, rules, s.sched, s.fman)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", name, err))
+		}
+		created = append(created, tp)
+		if found {
+			delete(running, name)
+			replaced[tp] = old
+			if old.baseTopic == tp.baseTopic {
+				tp.subID = old.subID
+			}
+		}
+		procs = append(procs, tp)
+	}
+
+	// the jobs of a replaced TopicProc would write the same files as its successor
+	for _, old := range replaced {
+		old.stop(s.sched)
+	}
+	s.swapTopicProcs(func([]*TopicProc) []*TopicProc {
+		// nothing reaches the replaced ones while their window moves over
+		for _, tp := range procs {
+			if old, found := replaced[tp]; found && old.baseTopic == tp.baseTopic {
+				tp.adoptWindow(old)
+			}
+		}
+		return procs
+	})
+
+	for _, tp := range running {
+		s.retire(tp)
+	}
+
+	s.settings = settings
+	s.rules = rules
+	InfoLogger.Printf("Reload: %d new, %d changed, %d removed, %d unchanged entries\n",
+		len(created)-len(replaced), len(replaced), len(running), len(procs)-len(created))
+	return nil
+}
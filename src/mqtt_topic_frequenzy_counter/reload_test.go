@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/jonboulle/clockwork"
+)
+
+func newTestScheduler(t *testing.T) gocron.Scheduler {
+	t.Helper()
+	sched, err := gocron.NewScheduler(gocron.WithClock(useFakeClock(t, testEpoch)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched.Start()
+	t.Cleanup(func() { sched.Shutdown() })
+	return sched
+}
+
+func TestNewTopicProcRemovesJobsOnError(t *testing.T) {
+	sched := newTestScheduler(t)
+	fman := &fileman{working_directory: t.TempDir()}
+
+	// the state job comes after the json, reset & sample jobs
+	entry := SettingsTopicEntry{Topic: "a/#", SaveStatsCron: "0 * * * * *", ResetStatsCron: "0 0 * * * *", SaveStateCron: "not a cron"}
+	if _, err := NewTopicProc(entry, sched, fman, InfoLogger); err == nil {
+		t.Fatal("an invalid save_state was accepted")
+	}
+	if jobs := sched.Jobs(); len(jobs) != 0 {
+		t.Errorf("%d jobs left behind", len(jobs))
+	}
+
+	entry.SaveStateCron = ""
+	tp, err := NewTopicProc(entry, sched, fman, InfoLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs := sched.Jobs(); len(jobs) != 3 {
+		t.Errorf("%d jobs, expected json, reset & state", len(jobs))
+	}
+	tp.stop(sched)
+	if jobs := sched.Jobs(); len(jobs) != 0 {
+		t.Errorf("%d jobs left after stop", len(jobs))
+	}
+}
+
+const TEST_RELOAD_BEFORE = `topics:
+  - topic: "a/#"
+    friendly_name: a
+    save_json: "0 * * * * *"
+  - topic: "b/#"
+    friendly_name: b
+  - topic: "c/#"
+    friendly_name: c
+`
+
+const TEST_RELOAD_AFTER = `topics:
+  - topic: "a/#"
+    friendly_name: a
+    save_json: "30 * * * * *"
+  - topic: "c/#"
+    friendly_name: c
+  - topic: "d/#"
+    friendly_name: d
+`
+
+/* Runs the entries of settings before like main does, the returned supervisor reloads from dir/settings.yaml */
+func setupTestReload(t *testing.T, before string) (*supervisor, string) {
+	t.Helper()
+	sched := newTestScheduler(t)
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "settings.yaml", before)
+	fman := &fileman{working_directory: dir}
+
+	saved := topicProcs
+	t.Cleanup(func() { topicProcs = saved })
+	topicProcs = nil
+
+	settings, err := loadSettings(path, false, InfoLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range settings.Topics {
+		tp, err := setupTopicProc(entry, settings, nil, sched, fman)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tp.subID = _takeSubID()
+		topicProcs = append(topicProcs, tp)
+	}
+	return &supervisor{ctx: context.Background(), args: ParsedArgs{settings: path}, settings: settings, sched: sched, fman: fman}, dir
+}
+
+func TestReloadReplacesJobs(t *testing.T) {
+	s, dir := setupTestReload(t, TEST_RELOAD_BEFORE)
+	before := make(map[string]*TopicProc)
+	for _, tp := range currentTopicProcs() {
+		before[tp.friendlyName] = tp
+	}
+
+	writeTestFile(t, dir, "settings.yaml", TEST_RELOAD_AFTER)
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	procs := currentTopicProcs()
+	names := make([]string, 0, len(procs))
+	want := 0
+	for _, tp := range procs {
+		names = append(names, tp.friendlyName)
+		for _, job := range []gocron.Job{tp._job_chart, tp._job_json, tp._job_reset, tp._job_state, tp._job_silence, tp._job_sample} {
+			if job != nil {
+				want++
+			}
+		}
+	}
+	if len(procs) != 3 || names[0] != "a" || names[1] != "c" || names[2] != "d" {
+		t.Fatalf("running %q after the reload, expected a, c & d", names)
+	}
+	// only the jobs of the running TopicProcs are left, the replaced a & the removed b are gone
+	if jobs := s.sched.Jobs(); len(jobs) != want {
+		t.Errorf("%d jobs, expected the %d of the running TopicProcs", len(jobs), want)
+	}
+	if procs[0] == before["a"] || procs[1] != before["c"] {
+		t.Error("a has to be replaced and c kept")
+	}
+	if procs[0].subID != before["a"].subID {
+		t.Errorf("a got subID %d instead of keeping %d", procs[0].subID, before["a"].subID)
+	}
+}
+
+/* A replaced TopicProc hands over its counts, rates & totals */
+func TestReloadKeepsCounts(t *testing.T) {
+	s, dir := setupTestReload(t, TEST_RELOAD_BEFORE)
+	fake := clock.(clockwork.FakeClock)
+	old := findTopicProc("a")
+	for i := 0; i < 60; i++ {
+		fake.Advance(time.Second)
+		old.process("a/x", 10)
+	}
+
+	rates := old._windows.namedRates("a/x", clock.Now())
+	if len(rates) != len(DEFAULT_WINDOWS) {
+		t.Fatalf("%d rates, expected one per default window", len(rates))
+	}
+
+	writeTestFile(t, dir, "settings.yaml", TEST_RELOAD_AFTER)
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	tp := findTopicProc("a")
+	if tp == old {
+		t.Fatal("a wasn't replaced")
+	}
+	for name, rate := range tp._windows.namedRates("a/x", clock.Now()) {
+		if rate != rates[name] || rate.MessagesPerSecond == 0 {
+			t.Errorf("%s rate %+v after the reload, %+v before", name, rate, rates[name])
+		}
+	}
+	fake.Advance(time.Second)
+	tp.process("a/x", 10)
+
+	tp._mutex.Lock()
+	defer tp._mutex.Unlock()
+	if tp.topicStore["a/x"] != 61 || tp.topicBytes["a/x"] != 610 {
+		t.Errorf("window holds %d messages & %d bytes, expected 61 & 610", tp.topicStore["a/x"], tp.topicBytes["a/x"])
+	}
+	if tp.topicStoreTotal["a/x"] != 61 || tp.topicBytesTotal["a/x"] != 610 {
+		t.Errorf("totals %d messages & %d bytes, expected 61 & 610", tp.topicStoreTotal["a/x"], tp.topicBytesTotal["a/x"])
+	}
+	if _, seen := tp.lastSeen["a/x"]; !seen {
+		t.Error("a/x was never seen")
+	}
+}
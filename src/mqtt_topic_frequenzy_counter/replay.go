@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+)
+
+/*
+The fake clock never moves more than this at once, the scheduler skips runs
+it missed, so bigger jumps would lose chart samples & resets
+*/
+const REPLAY_STEP = time.Second
+
+/* Without --cwd the files of a replay go next to the capture, into a directory with this suffix */
+const REPLAY_DIR_SUFFIX = ".replay"
+
+/* Set for a replay: no state is loaded & alerts are only logged, old data must not wake anybody up */
+var replaying bool
+
+/* Job runs of the scheduler that haven't finished yet, the replay waits for them before it moves on */
+var replayJobs sync.WaitGroup
+
+/* Reports the job runs of the scheduler to replayJobs */
+func replaySchedulerOption() gocron.SchedulerOption {
+	return gocron.WithGlobalJobOptions(gocron.WithEventListeners(
+		gocron.BeforeJobRuns(func(uuid.UUID, string) { replayJobs.Add(1) }),
+		gocron.AfterJobRuns(func(uuid.UUID, string) { replayJobs.Done() }),
+		gocron.AfterJobRunsWithError(func(uuid.UUID, string, error) { replayJobs.Done() }),
+	))
+}
+
+/*
+Waits until every job has its next run scheduled on the fake clock & the runs
+the last step fired are done. gocron schedules the next run before it starts a
+job, so once all jobs wait on the clock replayJobs has seen every started run.
+*/
+func settleReplay(ctx context.Context, fake clockwork.FakeClock, sched gocron.Scheduler) error {
+	// clockwork v0.4 has BlockUntilContext, just not in the FakeClock interface yet
+	blocker, ok := fake.(interface {
+		BlockUntilContext(ctx context.Context, n int) error
+	})
+	if !ok {
+		fake.BlockUntil(len(sched.Jobs()))
+	} else if err := blocker.BlockUntilContext(ctx, len(sched.Jobs())); err != nil {
+		return err
+	}
+	replayJobs.Wait()
+	return nil
+}
+
+/* Reads the start of the capture, the fake clock has to start there before the scheduler is created */
+func openReplay(path string) (*os.File, *captureReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := newCaptureReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, r, nil
+}
+
+/* Moves the fake clock to target in steps, waiting in real time according to speed (0 = as fast as possible) */
+func advanceReplayClock(ctx context.Context, fake clockwork.FakeClock, sched gocron.Scheduler, target time.Time, speed float64) error {
+	for fake.Now().Before(target) {
+		step := min(target.Sub(fake.Now()), REPLAY_STEP)
+
+		if speed > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(float64(step) / speed)):
+			}
+		}
+		fake.Advance(step)
+		if err := settleReplay(ctx, fake, sched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Feeds every record of the capture through the TopicProcs, routed by topic like
+routing: topic, so changed filters & excludes apply to old captures too.
+*/
+func runReplay(ctx context.Context, r *captureReader, fake clockwork.FakeClock, sched gocron.Scheduler, speed float64) (int, error) {
+	count := 0
+	if err := settleReplay(ctx, fake, sched); err != nil {
+		return count, err
+	}
+	for {
+		rec, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err = advanceReplayClock(ctx, fake, sched, rec.Time, speed); err != nil {
+			return count, err
+		}
+		routeByTopic(rec.Topic, rec.Size)
+		count++
+	}
+}
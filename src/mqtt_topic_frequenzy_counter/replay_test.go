@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+/* Every step has to run the jobs it is due for before the next one, without any real time passing */
+func TestAdvanceReplayClockRunsEveryJob(t *testing.T) {
+	fake := useFakeClock(t, testEpoch)
+	sched, err := gocron.NewScheduler(replaySchedulerOption(), gocron.WithClock(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched.Start()
+	defer sched.Shutdown()
+
+	var seconds, minutes atomic.Int32
+	var lastSecond atomic.Int64
+	if _, err = sched.NewJob(gocron.CronJob("* * * * * *", true), gocron.NewTask(func() {
+		seconds.Add(1)
+		// a slow job must not be overtaken by the next step
+		time.Sleep(time.Millisecond)
+		lastSecond.Store(fake.Now().Unix())
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sched.NewJob(gocron.CronJob("0 * * * * *", true), gocron.NewTask(func() { minutes.Add(1) })); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err = settleReplay(ctx, fake, sched); err != nil {
+		t.Fatal(err)
+	}
+	target := testEpoch.Add(10*time.Minute + 500*time.Millisecond)
+	if err = advanceReplayClock(ctx, fake, sched, target, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fake.Now().Equal(target) {
+		t.Errorf("clock is at %s, expected %s", fake.Now(), target)
+	}
+	if got := seconds.Load(); got != 600 {
+		t.Errorf("the every second job ran %d times, expected 600", got)
+	}
+	if got := lastSecond.Load(); got != testEpoch.Add(10*time.Minute).Unix() {
+		t.Errorf("the last run of the every second job saw %s", time.Unix(got, 0).UTC())
+	}
+	if got := minutes.Load(); got != 10 {
+		t.Errorf("the every minute job ran %d times, expected 10", got)
+	}
+}
+
+func TestAdvanceReplayClockCancel(t *testing.T) {
+	fake := useFakeClock(t, testEpoch)
+	sched, err := gocron.NewScheduler(replaySchedulerOption(), gocron.WithClock(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched.Start()
+	defer sched.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = advanceReplayClock(ctx, fake, sched, testEpoch.Add(time.Hour), 1); err == nil {
+		t.Error("a cancelled replay kept going")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+)
+
+const (
+	REPORT_FORMAT_TEXT = "text"
+	REPORT_FORMAT_CSV  = "csv"
+	REPORT_FORMAT_HTML = "html"
+)
+
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+
+type reportTopic struct {
+	Topic     string
+	Messages  uint64
+	Bytes     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Buckets   []uint64
+}
+
+/* Aggregate over the snapshots of one friendly name */
+type report struct {
+	FriendlyName string
+	From         time.Time
+	To           time.Time
+	Snapshots    int
+	HasBytes     bool
+	Bucket       time.Duration
+	BucketStarts []time.Time
+	Topics       []*reportTopic
+	New          []*reportTopic
+	Vanished     []*reportTopic
+}
+
+/* Hourly up to two days, daily up to two months, weekly beyond */
+func autoReportBucket(span time.Duration) time.Duration {
+	switch {
+	case span <= 48*time.Hour:
+		return time.Hour
+	case span <= 60*24*time.Hour:
+		return 24 * time.Hour
+	default:
+		return 7 * 24 * time.Hour
+	}
+}
+
+/* RFC3339, a date, a date & time or a go duration meaning that long ago */
+func parseReportTime(s string, now time.Time) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, "2006-01-02T15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d.Abs()), nil
+	}
+	return time.Time{}, fmt.Errorf("can't parse %q as time, use RFC3339, YYYY-MM-DD or a duration", s)
+}
+
+func buildReport(friendlyName string, snapshots []snapshot, bucket time.Duration) report {
+	r := report{FriendlyName: friendlyName, Snapshots: len(snapshots)}
+	if len(snapshots) == 0 {
+		return r
+	}
+
+	r.From = snapshots[0].Start
+	r.To = snapshots[len(snapshots)-1].Time
+	r.Bucket = bucket
+	if r.Bucket <= 0 {
+		r.Bucket = autoReportBucket(r.To.Sub(r.From))
+	}
+	first := r.From.Truncate(r.Bucket)
+	for t := first; t.Before(r.To) || len(r.BucketStarts) == 0; t = t.Add(r.Bucket) {
+		r.BucketStarts = append(r.BucketStarts, t)
+	}
+
+	topics := make(map[string]*reportTopic)
+	for _, s := range snapshots {
+		r.HasBytes = r.HasBytes || s.HasBytes
+		// a snapshot counts for the bucket its window is mostly in
+		middle := s.Start.Add(s.Time.Sub(s.Start) / 2)
+		idx := min(int(middle.Sub(first)/r.Bucket), len(r.BucketStarts)-1)
+		for topic, val := range s.Messages {
+			if val == 0 {
+				continue
+			}
+			t, ok := topics[topic]
+			if !ok {
+				t = &reportTopic{Topic: topic, FirstSeen: s.Time, Buckets: make([]uint64, len(r.BucketStarts))}
+				topics[topic] = t
+			}
+			t.Messages += val
+			t.Bytes += s.Bytes[topic]
+			t.LastSeen = s.Time
+			t.Buckets[idx] += val
+		}
+	}
+
+	for _, t := range topics {
+		r.Topics = append(r.Topics, t)
+	}
+	sort.SliceStable(r.Topics, func(i, j int) bool {
+		if r.Topics[i].Messages != r.Topics[j].Messages {
+			return r.Topics[i].Messages > r.Topics[j].Messages
+		}
+		return r.Topics[i].Topic < r.Topics[j].Topic
+	})
+
+	// with a single bucket nothing can be new or vanished
+	last := len(r.BucketStarts) - 1
+	for _, t := range r.Topics {
+		if last > 0 && t.Buckets[0] == 0 {
+			r.New = append(r.New, t)
+		}
+		if last > 0 && t.Buckets[last] == 0 {
+			r.Vanished = append(r.Vanished, t)
+		}
+	}
+	sort.SliceStable(r.New, func(i, j int) bool { return r.New[i].FirstSeen.Before(r.New[j].FirstSeen) })
+	sort.SliceStable(r.Vanished, func(i, j int) bool { return r.Vanished[i].LastSeen.Before(r.Vanished[j].LastSeen) })
+	return r
+}
+
+func (r *report) top(n int) []*reportTopic {
+	if n > 0 && len(r.Topics) > n {
+		return r.Topics[:n]
+	}
+	return r.Topics
+}
+
+func (r *report) perSecond(t *reportTopic) float64 {
+	return perSecond(t.Messages, r.To.Sub(r.From).Seconds())
+}
+
+/* Average per bucket of the second half against the first half, in percent */
+func (t *reportTopic) trend() (float64, bool) {
+	half := len(t.Buckets) / 2
+	if half == 0 {
+		return 0, false
+	}
+	var first, second uint64
+	for idx, val := range t.Buckets {
+		if idx < half {
+			first += val
+		} else if idx >= len(t.Buckets)-half {
+			second += val
+		}
+	}
+	if first == 0 {
+		return 0, false
+	}
+	return (float64(second) - float64(first)) / float64(first) * 100, true
+}
+
+func (t *reportTopic) trendString() string {
+	if pct, ok := t.trend(); ok {
+		return fmt.Sprintf("%+.0f%%", pct)
+	}
+	return "-"
+}
+
+/* One character per bucket, scaled to the highest one, empty buckets stay blank */
+func sparkline(buckets []uint64) string {
+	var highest uint64
+	for _, val := range buckets {
+		highest = max(highest, val)
+	}
+	var sb strings.Builder
+	for _, val := range buckets {
+		if highest == 0 || val == 0 {
+			sb.WriteRune(' ')
+			continue
+		}
+		sb.WriteRune(sparkLevels[int(val*uint64(len(sparkLevels)-1)/highest)])
+	}
+	return sb.String()
+}
+
+func (r *report) writeText(w io.Writer, topN int) error {
+	const stamp = "2006-01-02 15:04"
+	fmt.Fprintf(w, "Report for %s: %s - %s (%d snapshots, trend per %s)\n", r.FriendlyName, r.From.Format(stamp), r.To.Format(stamp), r.Snapshots, r.Bucket)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "\nTop talkers\n")
+	fmt.Fprintln(tw, "messages\tbytes\tmsg/s\ttrend\t\t  topic")
+	for _, t := range r.top(topN) {
+		bytes := "-"
+		if r.HasBytes {
+			bytes = strconv.FormatUint(t.Bytes, 10)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%.3f\t%s\t%s\t  %s\n", t.Messages, bytes, r.perSecond(t), t.trendString(), sparkline(t.Buckets), t.Topic)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nNew topics (nothing in the first %s)\n", r.Bucket)
+	fmt.Fprintln(tw, "first seen\tmessages\t  topic")
+	for _, t := range r.New {
+		fmt.Fprintf(tw, "%s\t%d\t  %s\n", t.FirstSeen.Format(stamp), t.Messages, t.Topic)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nVanished topics (nothing in the last %s)\n", r.Bucket)
+	fmt.Fprintln(tw, "last seen\tmessages\t  topic")
+	for _, t := range r.Vanished {
+		fmt.Fprintf(tw, "%s\t%d\t  %s\n", t.LastSeen.Format(stamp), t.Messages, t.Topic)
+	}
+	return tw.Flush()
+}
+
+/* One table, the section column tells top, trend, new & vanished rows apart */
+func (r *report) writeCSV(w io.Writer, topN int) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"section", "topic", "time", "messages", "bytes", "messages_per_second", "trend_percent", "first_seen", "last_seen"})
+
+	row := func(section string, t *reportTopic, at string, messages uint64) {
+		trend := ""
+		if pct, ok := t.trend(); ok {
+			trend = strconv.FormatFloat(pct, 'f', 1, 64)
+		}
+		cw.Write([]string{section, t.Topic, at, strconv.FormatUint(messages, 10), strconv.FormatUint(t.Bytes, 10),
+			strconv.FormatFloat(r.perSecond(t), 'f', 6, 64), trend, t.FirstSeen.Format(time.RFC3339), t.LastSeen.Format(time.RFC3339)})
+	}
+	for _, t := range r.top(topN) {
+		row("top", t, "", t.Messages)
+	}
+	for _, t := range r.top(topN) {
+		for idx, start := range r.BucketStarts {
+			row("trend", t, start.Format(time.RFC3339), t.Buckets[idx])
+		}
+	}
+	for _, t := range r.New {
+		row("new", t, t.FirstSeen.Format(time.RFC3339), t.Messages)
+	}
+	for _, t := range r.Vanished {
+		row("vanished", t, t.LastSeen.Format(time.RFC3339), t.Messages)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func reportBarChart(title string, subtitle string, topics []*reportTopic) *charts.Bar {
+	names := make([]string, 0, len(topics))
+	items := make([]opts.BarData, 0, len(topics))
+	for _, t := range topics {
+		names = append(names, t.Topic)
+		items = append(items, opts.BarData{Value: t.Messages})
+	}
+
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: "dark", Width: "100%", Height: "500px"}),
+		charts.WithTitleOpts(opts.Title{Title: title, Subtitle: subtitle}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+		charts.WithToolboxOpts(chartToolbox()),
+		charts.WithXAxisOpts(opts.XAxis{AxisLabel: &opts.AxisLabel{Rotate: 30, Interval: "0"}}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "messages"}),
+		charts.WithGridOpts(opts.Grid{Bottom: "30%"}),
+	)
+	bar.SetXAxis(names).AddSeries("messages", items)
+	return bar
+}
+
+func (r *report) writeHTML(w io.Writer, topN int) error {
+	const stamp = "2006-01-02 15:04"
+	period := fmt.Sprintf("%s - %s", r.From.Format(stamp), r.To.Format(stamp))
+
+	page := components.NewPage()
+	page.Layout = components.PageFlexLayout
+	page.PageTitle = "mqtt_topics report " + r.FriendlyName
+	page.Theme = "dark"
+
+	page.AddCharts(reportBarChart("Top talkers "+r.FriendlyName, period, r.top(topN)))
+
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: "dark", Width: "100%", Height: "600px"}),
+		charts.WithTitleOpts(opts.Title{Title: "Trend " + r.FriendlyName, Subtitle: fmt.Sprintf("messages per %s", r.Bucket)}),
+		charts.WithLegendOpts(opts.Legend{Type: "scroll", Top: "bottom"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+		charts.WithDataZoomOpts(opts.DataZoom{Type: "inside"}),
+		charts.WithToolboxOpts(chartToolbox()),
+		charts.WithXAxisOpts(opts.XAxis{Type: "time"}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "messages"}),
+	)
+	for _, t := range r.top(topN) {
+		items := make([]opts.LineData, 0, len(r.BucketStarts))
+		for idx, start := range r.BucketStarts {
+			items = append(items, opts.LineData{Value: []interface{}{start.UnixMilli(), t.Buckets[idx]}})
+		}
+		line.AddSeries(t.Topic, items)
+	}
+	page.AddCharts(line)
+
+	if len(r.New) > 0 {
+		page.AddCharts(reportBarChart("New topics "+r.FriendlyName, fmt.Sprintf("nothing in the first %s", r.Bucket), r.New))
+	}
+	if len(r.Vanished) > 0 {
+		page.AddCharts(reportBarChart("Vanished topics "+r.FriendlyName, fmt.Sprintf("nothing in the last %s", r.Bucket), r.Vanished))
+	}
+	return page.Render(w)
+}
+
+/* Snapshots are read from -cwd, or the path of the config */
+func reportDirectory(config string, cwd string) string {
+	if len(cwd) > 0 {
+		return cwd
+	}
+	settings, err := loadSettings(config, false, log.New(io.Discard, "", 0))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		WarningLogger.Printf("Ignoring settings: %s\n", err)
+	}
+	fman := fileman{}
+	if settings != nil {
+		fman.working_directory = settings.Path
+	}
+	return fman.getDirectory()
+}
+
+/* Picks the only friendly name in dir if none is given */
+func reportFriendlyName(dir string, name string) (string, error) {
+	if len(name) > 0 {
+		return name, nil
+	}
+	names, err := snapshotNames(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("found snapshots of %d friendly names in %s, pick one with -name: %s", len(names), dir, strings.Join(names, ", "))
+	}
+	return names[0], nil
+}
+
+/* report subcommand, returns the exit code */
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	config := fs.String("config", "", "settings file, its path is where the snapshots are read from")
+	cwd := fs.String("cwd", "", "directory with the snapshots, overrides the settings path")
+	name := fs.String("name", "", "friendly name (default the only one found)")
+	fromStr := fs.String("from", "", "start, RFC3339, YYYY-MM-DD or a duration ago like 168h")
+	toStr := fs.String("to", "", "end, same formats as -from")
+	format := fs.String("format", REPORT_FORMAT_TEXT, "text, csv or html")
+	out := fs.String("out", "", "output file (default stdout)")
+	topN := fs.Int("top", 10, "how many of the busiest topics to show, 0 = all")
+	bucket := fs.Duration("bucket", 0, "trend resolution (default depends on the time range)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	now := time.Now()
+	from, err := parseReportTime(*fromStr, now)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 2
+	}
+	to, err := parseReportTime(*toStr, now)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 2
+	}
+	if *format != REPORT_FORMAT_TEXT && *format != REPORT_FORMAT_CSV && *format != REPORT_FORMAT_HTML {
+		ErrorLogger.Printf("Unknown format %q, use text, csv or html\n", *format)
+		return 2
+	}
+
+	dir := reportDirectory(*config, *cwd)
+	friendlyName, err := reportFriendlyName(dir, *name)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 1
+	}
+	snapshots, err := loadSnapshots(dir, friendlyName, from, to)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 1
+	}
+	if len(snapshots) == 0 {
+		ErrorLogger.Printf("No snapshots of %s in %s for that time range\n", friendlyName, dir)
+		return 1
+	}
+	r := buildReport(friendlyName, snapshots, *bucket)
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			ErrorLogger.Println(err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case REPORT_FORMAT_CSV:
+		err = r.writeCSV(w, *topN)
+	case REPORT_FORMAT_HTML:
+		err = r.writeHTML(w, *topN)
+	default:
+		err = r.writeText(w, *topN)
+	}
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 1
+	}
+	return 0
+}
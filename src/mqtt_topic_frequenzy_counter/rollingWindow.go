@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var DEFAULT_WINDOWS = []string{"1m", "5m", "15m", "1h"}
+
+type windowRate struct {
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+}
+
+/* Ring buffer of buckets for one topic, head is the absolute index (time / width) of the newest bucket */
+type rollingCounter struct {
+	messages []uint32
+	bytes    []uint64
+	head     int64
+}
+
+/*
+Rolling windows over ring buffered buckets, all windows share the same buckets.
+The ring holds as many buckets as the longest window needs.
+*/
+type rollingWindows struct {
+	width    time.Duration
+	windows  []time.Duration
+	names    []string
+	slots    int64
+	started  time.Time
+	counters map[string]*rollingCounter
+}
+
+/* An empty bucket means 1/6 of the shortest window */
+func newRollingWindows(specs []string, bucket string, now time.Time) (rollingWindows, error) {
+	r := rollingWindows{
+		started:  now,
+		counters: make(map[string]*rollingCounter),
+	}
+
+	if len(specs) == 0 {
+		specs = DEFAULT_WINDOWS
+	}
+
+	var longest, shortest time.Duration
+	for _, spec := range specs {
+		w, err := time.ParseDuration(spec)
+		if err != nil {
+			return r, fmt.Errorf("windows: %w", err)
+		}
+		if w < time.Second {
+			return r, fmt.Errorf("windows: %s is shorter than a second", spec)
+		}
+		if shortest == 0 || w < shortest {
+			shortest = w
+			r.width = w / 6
+		}
+		if w > longest {
+			longest = w
+		}
+		r.windows = append(r.windows, w)
+		r.names = append(r.names, spec)
+	}
+
+	if len(bucket) > 0 {
+		w, err := time.ParseDuration(bucket)
+		if err != nil {
+			return r, fmt.Errorf("window_bucket: %w", err)
+		}
+		r.width = w
+	}
+	if r.width < time.Second {
+		r.width = time.Second
+	}
+	for idx, w := range r.windows {
+		if w < r.width {
+			return r, fmt.Errorf("windows: %s is shorter than window_bucket %s", r.names[idx], r.width)
+		}
+	}
+
+	r.slots = int64((longest + r.width - 1) / r.width)
+	return r, nil
+}
+
+func (r *rollingWindows) bucketIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(r.width)
+}
+
+func (r *rollingWindows) add(topic string, size int, now time.Time) {
+	c, ok := r.counters[topic]
+	if !ok {
+		c = &rollingCounter{
+			messages: make([]uint32, r.slots),
+			bytes:    make([]uint64, r.slots),
+			head:     r.bucketIndex(now),
+		}
+		r.counters[topic] = c
+	}
+
+	idx := r.bucketIndex(now)
+	if idx > c.head {
+		// clear everything between the old head and now, at most one round
+		from := c.head + 1
+		if idx-from >= r.slots {
+			from = idx - r.slots + 1
+		}
+		for i := from; i <= idx; i++ {
+			c.messages[i%r.slots] = 0
+			c.bytes[i%r.slots] = 0
+		}
+		c.head = idx
+	}
+	if idx <= c.head-r.slots {
+		return
+	}
+
+	c.messages[idx%r.slots]++
+	c.bytes[idx%r.slots] += uint64(size)
+}
+
+/* Sum over the newest n buckets as of now */
+func (r *rollingWindows) sum(c *rollingCounter, n int64, now time.Time) (uint64, uint64) {
+	var messages, bytes uint64
+	idx := r.bucketIndex(now)
+	for i := idx - n + 1; i <= idx; i++ {
+		if i > c.head || i <= c.head-r.slots {
+			continue
+		}
+		messages += uint64(c.messages[i%r.slots])
+		bytes += c.bytes[i%r.slots]
+	}
+	return messages, bytes
+}
+
+/* Rates of one topic, in the order of the configured windows */
+func (r *rollingWindows) rates(topic string, now time.Time) []windowRate {
+	rates := make([]windowRate, len(r.windows))
+	c, ok := r.counters[topic]
+	if !ok {
+		return rates
+	}
+
+	for idx, w := range r.windows {
+		messages, bytes := r.sum(c, int64((w+r.width-1)/r.width), now)
+
+		// right after the start the window is not filled yet
+		seconds := w.Seconds()
+		if up := now.Sub(r.started).Seconds(); up < seconds {
+			seconds = max(up, r.width.Seconds())
+		}
+		rates[idx] = windowRate{
+			MessagesPerSecond: float64(messages) / seconds,
+			BytesPerSecond:    float64(bytes) / seconds,
+		}
+	}
+	return rates
+}
+
+/* Messages of the newest n buckets as of now, oldest first */
+func (r *rollingWindows) recent(topic string, n int64, now time.Time) []uint64 {
+	buckets := make([]uint64, n)
+	c, ok := r.counters[topic]
+	if !ok {
+		return buckets
+	}
+
+	idx := r.bucketIndex(now)
+	for i := range buckets {
+		b := idx - n + 1 + int64(i)
+		if b > c.head || b <= c.head-r.slots {
+			continue
+		}
+		buckets[i] = uint64(c.messages[b%r.slots])
+	}
+	return buckets
+}
+
+/* Rates of one topic keyed by the window names */
+func (r *rollingWindows) namedRates(topic string, now time.Time) map[string]windowRate {
+	named := make(map[string]windowRate, len(r.names))
+	for idx, rate := range r.rates(topic, now) {
+		named[r.names[idx]] = rate
+	}
+	return named
+}
+
+/* Messages & bytes of every topic within the longest window as of now, and where that window starts */
+func (r *rollingWindows) longestSums(now time.Time) (topicMap, topicByteMap, time.Time) {
+	msgs := make(topicMap, len(r.counters))
+	bytes := make(topicByteMap, len(r.counters))
+	for topic, c := range r.counters {
+		m, b := r.sum(c, r.slots, now)
+		if m == 0 {
+			continue
+		}
+		msgs[topic] = uint32(m)
+		bytes[topic] = b
+	}
+
+	since := now.Add(-time.Duration(r.slots) * r.width)
+	if since.Before(r.started) {
+		since = r.started
+	}
+	return msgs, bytes, since
+}
+
+/* Forgets everything, the windows start filling up again */
+func (r *rollingWindows) reset(now time.Time) {
+	r.counters = make(map[string]*rollingCounter)
+	r.started = now
+}
+
+/* Drops topics that did not publish within the longest window */
+func (r *rollingWindows) prune(now time.Time) {
+	idx := r.bucketIndex(now)
+	for topic, c := range r.counters {
+		if c.head <= idx-r.slots {
+			delete(r.counters, topic)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestNewRollingWindows(t *testing.T) {
+	r, err := newRollingWindows(nil, "", testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(r.names, DEFAULT_WINDOWS) {
+		t.Errorf("names %v, expected the defaults %v", r.names, DEFAULT_WINDOWS)
+	}
+	// 1/6 of the shortest window, the ring holds the longest one
+	if r.width != 10*time.Second || r.slots != 360 {
+		t.Errorf("width %s & %d slots, expected 10s & 360", r.width, r.slots)
+	}
+
+	r, err = newRollingWindows([]string{"5s"}, "", testEpoch)
+	if err != nil || r.width != time.Second {
+		t.Errorf("buckets are at least a second, got %s, %v", r.width, err)
+	}
+
+	for _, c := range []struct {
+		specs  []string
+		bucket string
+	}{
+		{[]string{"nope"}, ""},
+		{[]string{"500ms"}, ""},
+		{[]string{"1m"}, "2m"},
+		{[]string{"1m"}, "nope"},
+	} {
+		if _, err := newRollingWindows(c.specs, c.bucket, testEpoch); err == nil {
+			t.Errorf("newRollingWindows(%v, %q) accepted invalid settings", c.specs, c.bucket)
+		}
+	}
+}
+
+func TestRollingWindowsRates(t *testing.T) {
+	// started long ago, the windows are full
+	r, err := newRollingWindows([]string{"1m", "5m"}, "10s", testEpoch.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one message of 100 bytes every 10s for 5 minutes
+	now := testEpoch
+	for i := 0; i < 30; i++ {
+		r.add("a", 100, now)
+		now = now.Add(10 * time.Second)
+	}
+	now = now.Add(-time.Second)
+
+	rates := r.rates("a", now)
+	if len(rates) != 2 {
+		t.Fatalf("%d rates, expected 2", len(rates))
+	}
+	if got := rates[0].MessagesPerSecond; got != 0.1 {
+		t.Errorf("1m: %f msg/s, expected 0.1", got)
+	}
+	if got := rates[0].BytesPerSecond; got != 10 {
+		t.Errorf("1m: %f B/s, expected 10", got)
+	}
+	if got := rates[1].MessagesPerSecond; got != 0.1 {
+		t.Errorf("5m: %f msg/s, expected 0.1", got)
+	}
+
+	named := r.namedRates("a", now)
+	if named["1m"] != rates[0] || named["5m"] != rates[1] {
+		t.Errorf("namedRates %v doesn't match rates %v", named, rates)
+	}
+	if unknown := r.rates("b", now); unknown[0].MessagesPerSecond != 0 {
+		t.Errorf("unknown topic has a rate: %v", unknown)
+	}
+
+	// after a quiet minute only the longer window remembers
+	now = now.Add(time.Minute)
+	rates = r.rates("a", now)
+	if rates[0].MessagesPerSecond != 0 || rates[1].MessagesPerSecond == 0 {
+		t.Errorf("after a quiet minute: %v", rates)
+	}
+}
+
+func TestRollingWindowsWarmup(t *testing.T) {
+	r, err := newRollingWindows([]string{"1m"}, "10s", testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		r.add("a", 1, testEpoch.Add(time.Duration(i)*time.Second))
+	}
+	// 20 messages within the first 20s aren't 20/60 per second
+	if got := r.rates("a", testEpoch.Add(20*time.Second))[0].MessagesPerSecond; got != 1 {
+		t.Errorf("%f msg/s during warmup, expected 1", got)
+	}
+}
+
+func TestRollingWindowsRingWraps(t *testing.T) {
+	r, err := newRollingWindows([]string{"30s"}, "10s", testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.add("a", 1, testEpoch)
+	// way past the ring, the old bucket must not come back around
+	later := testEpoch.Add(time.Hour)
+	r.add("a", 1, later)
+	m, _ := r.sum(r.counters["a"], r.slots, later)
+	if m != 1 {
+		t.Errorf("%d messages in the ring, expected 1", m)
+	}
+
+	// a late message older than the ring is dropped
+	r.add("a", 1, later.Add(-time.Minute))
+	if m, _ := r.sum(r.counters["a"], r.slots, later); m != 1 {
+		t.Errorf("a message older than the ring was counted, %d messages", m)
+	}
+}
+
+func TestRollingWindowsRecent(t *testing.T) {
+	r, err := newRollingWindows([]string{"1m"}, "10s", testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.add("a", 1, testEpoch)
+	r.add("a", 1, testEpoch.Add(20*time.Second))
+	r.add("a", 1, testEpoch.Add(21*time.Second))
+
+	got := r.recent("a", 4, testEpoch.Add(30*time.Second))
+	if want := []uint64{1, 0, 2, 0}; !slices.Equal(got, want) {
+		t.Errorf("recent %v, expected %v", got, want)
+	}
+	if got := r.recent("b", 3, testEpoch); !slices.Equal(got, []uint64{0, 0, 0}) {
+		t.Errorf("recent of an unknown topic %v", got)
+	}
+}
+
+func TestRollingWindowsLongestSumsPruneReset(t *testing.T) {
+	r, err := newRollingWindows([]string{"1m", "2m"}, "10s", testEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.add("a", 10, testEpoch)
+	r.add("b", 5, testEpoch.Add(90*time.Second))
+	r.add("b", 5, testEpoch.Add(95*time.Second))
+
+	now := testEpoch.Add(100 * time.Second)
+	msgs, bytes, since := r.longestSums(now)
+	if msgs["a"] != 1 || msgs["b"] != 2 || bytes["b"] != 10 {
+		t.Errorf("longestSums %v %v", msgs, bytes)
+	}
+	if !since.Equal(testEpoch) {
+		t.Errorf("the window starts %s, not before the windows started %s", since, testEpoch)
+	}
+
+	now = testEpoch.Add(150 * time.Second)
+	msgs, _, since = r.longestSums(now)
+	if _, found := msgs["a"]; found || msgs["b"] != 2 {
+		t.Errorf("longestSums after a moved out of the window: %v", msgs)
+	}
+	if want := now.Add(-2 * time.Minute); !since.Equal(want) {
+		t.Errorf("the window starts %s, expected %s", since, want)
+	}
+
+	r.prune(now)
+	if _, found := r.counters["a"]; found {
+		t.Error("prune kept a topic quiet for longer than the longest window")
+	}
+	if _, found := r.counters["b"]; !found {
+		t.Error("prune dropped an active topic")
+	}
+
+	r.reset(now)
+	if msgs, _, since := r.longestSums(now); len(msgs) != 0 || !since.Equal(now) {
+		t.Errorf("after reset: %v since %s", msgs, since)
+	}
+}
+
+/* Without reset_data topicStore counts since the start, the current counts have to come from the windows */
+func TestCurrentCountsFollowTheLongestWindow(t *testing.T) {
+	fake := useFakeClock(t, testEpoch)
+	entry := SettingsTopicEntry{FriendlyName: "test", Topic: "t/#", Windows: []string{"1m"}, WindowBucket: "10s"}
+
+	tp := newTestTopicProc(t, entry, t.TempDir())
+	tp.process("t/a", 10)
+	fake.Advance(2 * time.Minute)
+	tp.process("t/b", 20)
+
+	rows := tp.snapshotRows()
+	current := make(map[string]topicRow)
+	for _, row := range rows {
+		current[row.Topic] = row
+	}
+	if current["t/a"].Messages != 0 || current["t/a"].TotalMessages != 1 {
+		t.Errorf("t/a: %+v, expected only in the total", current["t/a"])
+	}
+	if current["t/b"].Messages != 1 || current["t/b"].Bytes != 20 {
+		t.Errorf("t/b: %+v", current["t/b"])
+	}
+	if want := clock.Now().Add(-time.Minute); !tp.currentWindowStart(clock.Now()).Equal(want) {
+		t.Errorf("window start %s, expected %s", tp.currentWindowStart(clock.Now()), want)
+	}
+
+	// a manual reset starts the window over
+	tp.ResetStats()
+	for _, row := range tp.snapshotRows() {
+		if row.Messages != 0 {
+			t.Errorf("%s has %d messages after the reset", row.Topic, row.Messages)
+		}
+	}
+
+	// with reset_data the window is the one between the resets
+	entry.ResetStatsCron = "0 * * * * *"
+	tp = newTestTopicProc(t, entry, t.TempDir())
+	tp.process("t/a", 10)
+	fake.Advance(2 * time.Minute)
+	if rows := tp.snapshotRows(); rows[0].Messages != 1 {
+		t.Errorf("with reset_data: %+v", rows[0])
+	}
+}
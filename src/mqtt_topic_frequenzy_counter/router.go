@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+/*
+subscription_id: every TopicProc gets its own subscription, incoming messages are
+routed by the MQTT v5 subscription identifier. Falls back to topic routing if the
+broker does not support subscription identifiers.
+
+topic: subscriptions are made without identifiers (for brokers and bridges
+that don't support them) and incoming topics are matched against the
+baseTopic of every TopicProc locally.
+*/
+const (
+	ROUTING_SUBSCRIPTION_ID = "subscription_id"
+	ROUTING_TOPIC           = "topic"
+)
+
+/* Routing mode of the current connection, may differ from the configured one after a fallback */
+var subIDRouting atomic.Bool
+
+func isValidRoutingMode(mode string) bool {
+	return len(mode) == 0 || mode == ROUTING_SUBSCRIPTION_ID || mode == ROUTING_TOPIC
+}
+
+/* Decides how to route on this connection, based on the settings and the brokers CONNACK */
+func selectRouting(mode string, prop *paho.ConnackProperties) {
+	if mode == ROUTING_TOPIC {
+		subIDRouting.Store(false)
+		return
+	}
+
+	if prop != nil && !prop.SubIDAvailable {
+		WarningLogger.Println("Broker does not support subscription identifiers, falling back to topic routing")
+		subIDRouting.Store(false)
+		return
+	}
+	subIDRouting.Store(true)
+}
+
+/* Reports if every topic matched by filter b is matched by filter a as well */
+func filterCovers(a string, b string) bool {
+	if strings.HasPrefix(b, "$") && (strings.HasPrefix(a, "+") || strings.HasPrefix(a, "#")) {
+		return false
+	}
+
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	for idx, al := range aLevels {
+		if al == "#" {
+			return true
+		}
+		if idx >= len(bLevels) {
+			return false
+		}
+		bl := bLevels[idx]
+		if bl == "#" {
+			return false
+		}
+		if al == "+" {
+			continue
+		}
+		if bl == "+" || al != bl {
+			return false
+		}
+	}
+	return len(aLevels) == len(bLevels)
+}
+
+/*
+Reduces the filters to a set without overlaps, so the broker
+delivers each message only once when routing by topic.
+*/
+func minimalFilterSet(filters []string) []string {
+	unique := UniqueStringArray{array: make(map[string]bool)}
+	distinct := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if !unique.HasString(f) {
+			unique.AddString(f)
+			distinct = append(distinct, f)
+		}
+	}
+
+	result := make([]string, 0, len(distinct))
+	for _, f := range distinct {
+		covered := false
+		for _, other := range distinct {
+			if other != f && filterCovers(other, f) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+/* Filter -> subscription identifier the current routing needs, 0 = without identifier. Includes the control topic */
+func wantedSubscriptions(procs []*TopicProc) map[string]int {
+	subs := make(map[string]int, len(procs)+1)
+	if subIDRouting.Load() {
+		for _, tp := range procs {
+			subs[tp.baseTopic] = tp.subID
+		}
+		if len(controlSettings.Topic) > 0 {
+			subs[controlSettings.Topic] = CONTROL_SUB_ID
+		}
+		return subs
+	}
+
+	filters := make([]string, 0, len(procs)+1)
+	for _, tp := range procs {
+		filters = append(filters, tp.baseTopic)
+	}
+	if len(controlSettings.Topic) > 0 {
+		filters = append(filters, controlSettings.Topic)
+	}
+	for _, filter := range minimalFilterSet(filters) {
+		subs[filter] = 0
+	}
+	return subs
+}
+
+/* Hands the publish to every matching TopicProc, reports if anyone took it */
+func routePublish(p *paho.Publish) bool {
+	// watches overlapping the control topic still count its messages
+	if subIDRouting.Load() && p.Properties != nil && p.Properties.SubscriptionIdentifier != nil && *p.Properties.SubscriptionIdentifier != CONTROL_SUB_ID {
+		return routeBySubID(*p.Properties.SubscriptionIdentifier, p.Topic, len(p.Payload))
+	}
+
+	return routeByTopic(p.Topic, len(p.Payload))
+}
+
+func routeBySubID(subID int, topic string, size int) bool {
+	topicProcsMutex.RLock()
+	defer topicProcsMutex.RUnlock()
+
+	found := false
+	for _, val := range topicProcs {
+		if val.subID == subID {
+			found = true
+			val.process(topic, size)
+		}
+	}
+	return found
+}
+
+/* Hands the message to every TopicProc whose filter matches, also used by replay */
+func routeByTopic(topic string, size int) bool {
+	topicProcsMutex.RLock()
+	defer topicProcsMutex.RUnlock()
+
+	found := false
+	for _, val := range topicProcs {
+		if topicMatchesFilter(val.baseTopic, topic) {
+			found = true
+			val.process(topic, size)
+		}
+	}
+	return found
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFilterCovers(t *testing.T) {
+	cases := []struct {
+		a, b   string
+		covers bool
+	}{
+		{"#", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/b", "a/+", false},
+		{"a/+", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a/c", false},
+		{"#", "$SYS/#", false},
+		{"+/x", "$SYS/x", false},
+	}
+	for _, c := range cases {
+		if got := filterCovers(c.a, c.b); got != c.covers {
+			t.Errorf("filterCovers(%q, %q) = %t, expected %t", c.a, c.b, got, c.covers)
+		}
+	}
+}
+
+func TestMinimalFilterSet(t *testing.T) {
+	cases := []struct {
+		filters []string
+		want    []string
+	}{
+		{nil, []string{}},
+		{[]string{"a/b", "a/b"}, []string{"a/b"}},
+		{[]string{"zigbee2mqtt/+/set", "zigbee2mqtt/#"}, []string{"zigbee2mqtt/#"}},
+		{[]string{"a/+", "a/b", "b/#", "c"}, []string{"a/+", "b/#", "c"}},
+		{[]string{"#", "$SYS/#", "a"}, []string{"#", "$SYS/#"}},
+		{[]string{"a/+/c", "a/b/+"}, []string{"a/+/c", "a/b/+"}},
+	}
+	for _, c := range cases {
+		got := minimalFilterSet(c.filters)
+		slices.Sort(got)
+		want := slices.Clone(c.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("minimalFilterSet(%q) = %q, expected %q", c.filters, got, want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+name: shows up in the alert
+friendly_name: only apply to this topic entry (empty = all entries)
+pattern: topic pattern, same syntax as exclude_topics
+window: go duration the limits apply to
+max_messages, max_bytes: a topic above one of them within window fires (0 = no limit)
+cooldown: go duration, a rule fires at most once per topic within it (default = window)
+notify: where to send the alert to, defaults to alerts
+*/
+type SettingsRule struct {
+	Name         string         `yaml:"name"`
+	FriendlyName string         `yaml:"friendly_name"`
+	Pattern      string         `yaml:"pattern"`
+	Window       string         `yaml:"window"`
+	MaxMessages  uint64         `yaml:"max_messages"`
+	MaxBytes     uint64         `yaml:"max_bytes"`
+	Cooldown     string         `yaml:"cooldown"`
+	Notify       SettingsNotify `yaml:"notify"`
+}
+
+type alertRule struct {
+	name         string
+	friendlyName string
+	pattern      topicPattern
+	window       time.Duration
+	maxMessages  uint64
+	maxBytes     uint64
+	cooldown     time.Duration
+	notify       SettingsNotify
+}
+
+/*
+Sliding window approximation: the previous window is weighted
+by how much of it still overlaps with the sliding window.
+*/
+type ruleCounter struct {
+	windowStart  time.Time
+	messages     uint64
+	bytes        uint64
+	prevMessages uint64
+	prevBytes    uint64
+	lastFired    time.Time
+	lastSeen     time.Time
+}
+
+type ruleCounterKey struct {
+	rule  *alertRule
+	topic string
+}
+
+type ruleFiring struct {
+	alert  Alert
+	notify SettingsNotify
+}
+
+/* Counters of topics gone quiet are dropped every RULE_PRUNE_INTERVAL, topics come & go */
+const RULE_PRUNE_INTERVAL = time.Minute
+
+type ruleEngine struct {
+	rules    []*alertRule
+	counters map[ruleCounterKey]*ruleCounter
+	pruned   time.Time
+}
+
+func compileRule(setting SettingsRule, defaultNotify SettingsNotify) (*alertRule, error) {
+	var err error
+	r := &alertRule{
+		name:         setting.Name,
+		friendlyName: setting.FriendlyName,
+		maxMessages:  setting.MaxMessages,
+		maxBytes:     setting.MaxBytes,
+		notify:       setting.Notify,
+	}
+
+	if len(r.name) == 0 {
+		r.name = setting.Pattern
+	}
+	if r.maxMessages == 0 && r.maxBytes == 0 {
+		return nil, errors.New("max_messages or max_bytes required")
+	}
+
+	if r.pattern, err = compileTopicPattern(setting.Pattern); err != nil {
+		return nil, err
+	}
+	if r.window, err = time.ParseDuration(setting.Window); err != nil {
+		return nil, fmt.Errorf("window: %w", err)
+	}
+	if r.window <= 0 {
+		return nil, errors.New("window has to be positive")
+	}
+
+	r.cooldown = r.window
+	if len(setting.Cooldown) > 0 {
+		if r.cooldown, err = time.ParseDuration(setting.Cooldown); err != nil {
+			return nil, fmt.Errorf("cooldown: %w", err)
+		}
+	}
+
+	if r.notify.isEmpty() {
+		r.notify = defaultNotify
+	}
+	return r, nil
+}
+
+func compileRules(settings *SettingsStruct) ([]*alertRule, error) {
+	rules := make([]*alertRule, 0, len(settings.Rules))
+	for idx, entry := range settings.Rules {
+		r, err := compileRule(entry, settings.Alerts)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d] (%s): %w", idx, entry.Name, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+/* Picks the rules applying to the given topic entry */
+func newRuleEngine(rules []*alertRule, friendlyName string) ruleEngine {
+	e := ruleEngine{counters: make(map[ruleCounterKey]*ruleCounter)}
+	for _, r := range rules {
+		if len(r.friendlyName) == 0 || r.friendlyName == friendlyName {
+			e.rules = append(e.rules, r)
+		}
+	}
+	return e
+}
+
+/* After this long without a message a counter holds nothing of the window & the cooldown ran out */
+func (r *alertRule) idle() time.Duration {
+	return r.window + max(r.window, r.cooldown)
+}
+
+/* Drops the counters idle longer than their rule cares about */
+func (e *ruleEngine) prune(now time.Time) {
+	for key, c := range e.counters {
+		if now.Sub(c.lastSeen) > key.rule.idle() {
+			delete(e.counters, key)
+		}
+	}
+	e.pruned = now
+}
+
+func (c *ruleCounter) advance(now time.Time, window time.Duration) {
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < window {
+		return
+	}
+	if elapsed < 2*window {
+		c.prevMessages, c.prevBytes = c.messages, c.bytes
+		c.windowStart = c.windowStart.Add(window)
+	} else {
+		c.prevMessages, c.prevBytes = 0, 0
+		c.windowStart = now
+	}
+	c.messages, c.bytes = 0, 0
+}
+
+func (c *ruleCounter) estimate(now time.Time, window time.Duration) (uint64, uint64) {
+	weight := 1 - float64(now.Sub(c.windowStart))/float64(window)
+	return c.messages + uint64(float64(c.prevMessages)*weight), c.bytes + uint64(float64(c.prevBytes)*weight)
+}
+
+/* Counts the message for every matching rule, returns the rules that fired */
+func (e *ruleEngine) observe(friendlyName string, topic string, size int, now time.Time) []ruleFiring {
+	var fired []ruleFiring
+
+	if now.Sub(e.pruned) >= RULE_PRUNE_INTERVAL {
+		e.prune(now)
+	}
+	for _, r := range e.rules {
+		if !r.pattern.match(topic) {
+			continue
+		}
+
+		key := ruleCounterKey{rule: r, topic: topic}
+		c, ok := e.counters[key]
+		if !ok {
+			c = &ruleCounter{windowStart: now}
+			e.counters[key] = c
+		}
+		c.advance(now, r.window)
+		c.lastSeen = now
+		c.messages++
+		c.bytes += uint64(size)
+
+		if !c.lastFired.IsZero() && now.Sub(c.lastFired) < r.cooldown {
+			continue
+		}
+
+		messages, bytes := c.estimate(now, r.window)
+		alert := Alert{
+			Kind:         ALERT_RULE,
+			FriendlyName: friendlyName,
+			Topic:        topic,
+			Time:         now,
+			Rule:         r.name,
+		}
+		switch {
+		case r.maxMessages > 0 && messages > r.maxMessages:
+			alert.Value, alert.Limit = messages, r.maxMessages
+			alert.Message = fmt.Sprintf("%s: %d messages within %s (max %d)", topic, messages, r.window, r.maxMessages)
+		case r.maxBytes > 0 && bytes > r.maxBytes:
+			alert.Value, alert.Limit = bytes, r.maxBytes
+			alert.Message = fmt.Sprintf("%s: %d bytes within %s (max %d)", topic, bytes, r.window, r.maxBytes)
+		default:
+			continue
+		}
+
+		c.lastFired = now
+		fired = append(fired, ruleFiring{alert: alert, notify: r.notify})
+	}
+	return fired
+}
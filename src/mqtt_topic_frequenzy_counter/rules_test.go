@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRuleEngineCooldown(t *testing.T) {
+	r, err := compileRule(SettingsRule{Name: "chatty", Pattern: "a/#", Window: "1m", MaxMessages: 5, Cooldown: "5m"}, SettingsNotify{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newRuleEngine([]*alertRule{r}, "t")
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	send := func(n int) (fired []int) {
+		for i := 1; i <= n; i++ {
+			now = now.Add(time.Second)
+			for _, f := range e.observe("t", "a/x", 10, now) {
+				if f.alert.Rule != "chatty" || f.alert.Value <= f.alert.Limit {
+					t.Errorf("fired %+v", f.alert)
+				}
+				fired = append(fired, i)
+			}
+		}
+		return fired
+	}
+
+	// the 6th message within the minute crosses max_messages
+	if fired := send(10); len(fired) != 1 || fired[0] != 6 {
+		t.Errorf("fired at messages %v, expected once at the 6th", fired)
+	}
+	// still above the limit but within the cooldown
+	if fired := send(240); len(fired) != 0 {
+		t.Errorf("fired at messages %v within the cooldown", fired)
+	}
+	// the cooldown runs out 5 minutes after the first alert, at 306s
+	if fired := send(60); len(fired) != 1 || fired[0] != 56 {
+		t.Errorf("fired at messages %v, expected once after the cooldown", fired)
+	}
+}
+
+func TestRuleEnginePrunesIdleCounters(t *testing.T) {
+	r, err := compileRule(SettingsRule{Pattern: "a/#", Window: "1m", MaxMessages: 100, Cooldown: "2m"}, SettingsNotify{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newRuleEngine([]*alertRule{r}, "t")
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		e.observe("t", fmt.Sprintf("a/once/%d", i), 1, now)
+	}
+	if len(e.counters) != 50 {
+		t.Fatalf("%d counters, expected 50", len(e.counters))
+	}
+	// window + cooldown without a message, only a/busy keeps its counter
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Minute)
+		e.observe("t", "a/busy", 1, now)
+	}
+	if _, found := e.counters[ruleCounterKey{rule: r, topic: "a/busy"}]; len(e.counters) != 1 || !found {
+		t.Errorf("%d counters left, expected only a/busy", len(e.counters))
+	}
+}
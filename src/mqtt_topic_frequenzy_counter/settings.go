@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -13,27 +17,88 @@ const (
 )
 
 /*
-friendly_name: Name in chart legend
+friendly_name: Name in chart legend & of the files, no / or \ (default the topic with / + # replaced, e.g. a_plus_hash)
 topic: the topic to watch
 save_chart: cron string
 save_json: Cron string
+reset_data: Cron string, legacy mode: pushes the counters to the chart and starts a new window (without it the current counts are of the longest window)
+sample_chart: Cron string, pushes what arrived since the last sample to the chart (default every minute without reset_data)
+windows: rolling windows the rates are calculated for (default 1m, 5m, 15m, 1h)
+window_bucket: go duration, resolution of the rolling windows (default 1/6 of the shortest window)
+save_state: Cron string, checkpoints alltime counters & chart history (default every 5 minutes)
+retention: list of resolution & keep, the chart history is consolidated into these tiers (default 1m/24h, 1h/720h, 24h/8760h)
+chart_resolution: which retention resolution save_chart & /chart render (default the finest)
+chart_types: charts on the page, any of bar (top n of the current window), heatmap (topic x time) & line (default all three)
+chart_top_n: how many of the busiest topics the bar & line charts show (default 20)
+include_topics: only count topics matching one of these patterns (empty = everything)
+exclude_topics: don't count topics matching one of these patterns
+
+stats_topic: on every save_json tick a summary is published retained to this topic (empty = off)
+stats_top_n: how many of the busiest topics the summary contains (default 10)
+
+expected_interval: go duration, alert when a seen topic stays silent for longer (empty = off)
+expected_intervals: list of pattern & interval, overrides expected_interval for matching topics
+
+Patterns are MQTT topic filters (+ and # wildcards, plain topics match exactly)
+or regular expressions prefixed with "re:"
 */
 type SettingsTopicEntry struct {
-	FriendlyName   string   `yaml:"friendly_name"`
-	Topic          string   `yaml:"topic"`
-	SaveChartCron  string   `yaml:"save_chart"`
-	SaveStatsCron  string   `yaml:"save_json"`
-	ResetStatsCron string   `yaml:"reset_data"`
-	IgnoreTopics   []string `yaml:"exclude_topics"`
+	FriendlyName    string   `yaml:"friendly_name"`
+	Topic           string   `yaml:"topic"`
+	SaveChartCron   string   `yaml:"save_chart"`
+	SaveStatsCron   string   `yaml:"save_json"`
+	ResetStatsCron  string   `yaml:"reset_data"`
+	SampleChartCron string   `yaml:"sample_chart"`
+	SaveStateCron   string   `yaml:"save_state"`
+	IgnoreTopics    []string `yaml:"exclude_topics"`
+	IncludeTopics   []string `yaml:"include_topics"`
+	StatsTopic      string   `yaml:"stats_topic"`
+	StatsTopN       int      `yaml:"stats_top_n"`
+	Windows         []string `yaml:"windows"`
+	WindowBucket    string   `yaml:"window_bucket"`
+
+	Retention       []SettingsRetention `yaml:"retention"`
+	ChartResolution string              `yaml:"chart_resolution"`
+	ChartTypes      []string            `yaml:"chart_types"`
+	ChartTopN       int                 `yaml:"chart_top_n"`
+
+	ExpectedInterval  string                     `yaml:"expected_interval"`
+	ExpectedIntervals []SettingsExpectedInterval `yaml:"expected_intervals"`
 }
 
+/*
+listen: address for the builtin http server, e.g. ":8080". Empty disables it
+metrics_max_series: max topics exported on /metrics, the rest is summed up as topic "__other__". 0 = unlimited
+api_token: requests of /api changing something need "Authorization: Bearer <api_token>", without it /api is read only, see api.go
+*/
+type SettingsHttp struct {
+	Listen           string `yaml:"listen"`
+	MetricsMaxSeries int    `yaml:"metrics_max_series"`
+	ApiToken         string `yaml:"api_token"`
+}
+
+/*
+routing: subscription_id (default) or topic, see router.go
+alerts: where alerts are sent to, see SettingsNotify
+rules: rate limits per topic, see SettingsRule
+homeassistant: mqtt discovery, see SettingsHomeAssistant
+control: runtime commands over MQTT, see SettingsControl
+*/
 type SettingsStruct struct {
 	Topics   []SettingsTopicEntry `yaml:"topics"`
+	Http     SettingsHttp         `yaml:"http"`
 	Url      string               `yaml:"url"`
 	User     string               `yaml:"user"`
 	Passwd   string               `yaml:"password"`
 	ClientID string               `yaml:"client_id"`
 	Path     string               `yaml:"path"`
+	Routing  string               `yaml:"routing"`
+	Tls      SettingsTls          `yaml:"tls"`
+	Alerts   SettingsNotify       `yaml:"alerts"`
+	Rules    []SettingsRule       `yaml:"rules"`
+
+	HomeAssistant SettingsHomeAssistant `yaml:"homeassistant"`
+	Control       SettingsControl       `yaml:"control"`
 }
 
 func loadSettings(path string, debug bool, log *log.Logger) (*SettingsStruct, error) {
@@ -58,14 +123,23 @@ func loadSettings(path string, debug bool, log *log.Logger) (*SettingsStruct, er
 	}
 
 	log.Println("Parsing Settings...")
-	temp := newSettings
-	err = yaml.Unmarshal(file, temp)
-	if err != nil {
+	// unknown keys are errors, a typo shouldn't silently fall back to the default
+	dec := yaml.NewDecoder(bytes.NewReader(file))
+	dec.KnownFields(true)
+	if err = dec.Decode(newSettings); err != nil && !errors.Is(err, io.EOF) {
 		return nil, err
 	}
 
 	if debug {
-		log.Printf("yaml: %#v\n", temp)
+		log.Printf("yaml: %#v\n", newSettings)
+	}
+
+	if err = newSettings.validate(); err != nil {
+		var root yaml.Node
+		if yaml.Unmarshal(file, &root) == nil {
+			err = addSettingsLines(err, &root)
+		}
+		return nil, err
 	}
 
 	log.Printf("yaml: is sane? %t\n", newSettings.sanitize())
@@ -83,12 +157,72 @@ func (d *SettingsStruct) sanitize() bool {
 	return true
 }
 
+/* Checks everything NewTopicProc & setupMqtt would fail on later, all errors are joined */
+func (d *SettingsStruct) validate() error {
+	errs := make([]error, 0)
+	add := func(path []any, label string, err error) {
+		if err != nil {
+			errs = append(errs, SettingsError{Path: path, Label: label, Err: err})
+		}
+	}
+
+	if !isValidRoutingMode(d.Routing) {
+		add(nil, "", fmt.Errorf("routing: unknown mode %q, use %s or %s", d.Routing, ROUTING_SUBSCRIPTION_ID, ROUTING_TOPIC))
+	}
+	if len(d.Url) > 0 {
+		add([]any{"url"}, "", validateBrokerUrl(d.Url))
+	}
+	_, err := d.Tls.tlsConfig()
+	add(nil, "", err)
+	for _, err := range d.Alerts.validate() {
+		add([]any{"alerts"}, "", err)
+	}
+
+	for _, err := range d.Control.validate() {
+		add([]any{"control"}, "", err)
+	}
+
+	for idx, rule := range d.Rules {
+		_, err := compileRule(rule, d.Alerts)
+		add([]any{"rules", idx}, rule.Name, err)
+		for _, err := range rule.Notify.validate() {
+			add([]any{"rules", idx, "notify"}, rule.Name, err)
+		}
+	}
+
+	names := make(map[string]int)
+	for idx, entry := range d.Topics {
+		path := []any{"topics", idx}
+		label := entry.name()
+		for _, err := range entry.validate() {
+			add(path, label, err)
+		}
+		if len(label) == 0 {
+			continue
+		}
+		if prev, found := names[label]; found {
+			add(path, label, fmt.Errorf("friendly_name: %q is already used by topics[%d]", label, prev))
+		} else {
+			names[label] = idx
+		}
+	}
+	return errors.Join(errs...)
+}
+
 type EmptyString struct{}
 
 func (EmptyString) Error() string {
 	return "Both strings are empty"
 }
 
+/* The friendly name, unnamed entries get one from their topic so it works in file names & urls */
+func (entry SettingsTopicEntry) name() string {
+	if len(entry.FriendlyName) > 0 {
+		return entry.FriendlyName
+	}
+	return topicFriendlyName(entry.Topic)
+}
+
 func getBetterString(s1 string, s2 string) (string, error) {
 	if len(s1) > 0 {
 		return s1, nil
@@ -103,3 +237,48 @@ func getBetterStringNoErr(s1 string, s2 string) string {
 	s, _ := getBetterString(s1, s2)
 	return s
 }
+
+func getBetterInt(i1 int, i2 int) int {
+	if i1 > 0 {
+		return i1
+	}
+	return i2
+}
+
+/* validate (alias validate-config) subcommand, returns the exit code so deployments can be gated on it */
+func runValidateConfig(command string, args []string) int {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	config := fs.String("config", os.Getenv(ENV_CONFIG), "settings file (default "+ETC_SETTINGS_PATH+", env "+ENV_CONFIG+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-config FILE | FILE]\n", command)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		*config = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	path := getBetterStringNoErr(*config, ETC_SETTINGS_PATH)
+	settings, err := loadSettings(*config, false, log.New(io.Discard, "", 0))
+	if err != nil {
+		var joined interface{ Unwrap() []error }
+		if errors.As(err, &joined) {
+			ErrorLogger.Printf("%s is invalid, %d errors:\n", path, len(joined.Unwrap()))
+			for _, e := range joined.Unwrap() {
+				fmt.Fprintf(os.Stderr, "  %s\n", e)
+			}
+		} else {
+			ErrorLogger.Printf("%s is invalid: %s\n", path, err)
+		}
+		return 1
+	}
+	fmt.Printf("%s is valid, %d topic entries\n", path, len(settings.Topics))
+	return 0
+}
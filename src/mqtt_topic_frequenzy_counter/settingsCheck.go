@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+/* Schemes autopaho can connect with */
+var BROKER_URL_SCHEMES = []string{"mqtt", "tcp", "mqtts", "ssl", "tls", "ws", "wss"}
+
+/* The same parser gocron uses for CronJob(..., true) */
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+/*
+An invalid setting. Path holds the yaml keys (string) & list indices (int) leading to it,
+Label is shown next to it (e.g. the friendly name), Line is set by loadSettings.
+*/
+type SettingsError struct {
+	Path  []any
+	Label string
+	Line  int
+	Err   error
+}
+
+func (e SettingsError) Error() string {
+	var sb strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&sb, "line %d: ", e.Line)
+	}
+	for idx, p := range e.Path {
+		switch v := p.(type) {
+		case int:
+			fmt.Fprintf(&sb, "[%d]", v)
+		default:
+			if idx > 0 {
+				sb.WriteString(".")
+			}
+			fmt.Fprint(&sb, v)
+		}
+	}
+	if len(e.Label) > 0 {
+		fmt.Fprintf(&sb, " (%s)", e.Label)
+	}
+	if len(e.Path) > 0 {
+		sb.WriteString(": ")
+	}
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (e SettingsError) Unwrap() error {
+	return e.Err
+}
+
+/* Most errors in here start with the key they are about, e.g. "retention[1]: keep: ..." */
+var errorKeyPrefix = regexp.MustCompile(`^([a-z_]+)(?:\[(\d+)\])?: `)
+
+/* Path plus the keys the error message starts with */
+func (e SettingsError) fullPath() []any {
+	path := slices.Clone(e.Path)
+	msg := e.Err.Error()
+	for {
+		m := errorKeyPrefix.FindStringSubmatch(msg)
+		if m == nil {
+			return path
+		}
+		path = append(path, m[1])
+		if len(m[2]) > 0 {
+			idx, _ := strconv.Atoi(m[2])
+			path = append(path, idx)
+		}
+		msg = msg[len(m[0]):]
+	}
+}
+
+/* Line of the deepest node along path that exists */
+func nodeLine(root *yaml.Node, path []any) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch v := p.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && v < len(node.Content) {
+				next = node.Content[v]
+			}
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == v {
+						line = node.Content[i].Line
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+		line = node.Line
+	}
+	return line
+}
+
+/* Fills in the line numbers of every SettingsError in err (also within errors.Join) */
+func addSettingsLines(err error, root *yaml.Node) error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs := joined.Unwrap()
+		for idx := range errs {
+			errs[idx] = addSettingsLines(errs[idx], root)
+		}
+		return errors.Join(errs...)
+	}
+	var se SettingsError
+	if errors.As(err, &se) {
+		se.Line = nodeLine(root, se.fullPath())
+		return se
+	}
+	return err
+}
+
+func validateCron(spec string) error {
+	if _, err := cronParser.Parse(spec); err != nil {
+		return fmt.Errorf("invalid cron %q: %w", spec, err)
+	}
+	return nil
+}
+
+func validateBrokerUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(BROKER_URL_SCHEMES, u.Scheme) {
+		return fmt.Errorf("unknown scheme %q, use one of %s", u.Scheme, strings.Join(BROKER_URL_SCHEMES, ", "))
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+func validateWebhookUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unknown scheme %q, use http or https", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+/* Topics we publish to, no wildcards allowed */
+func validatePublishTopic(topic string) error {
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%q: wildcards are not allowed when publishing", topic)
+	}
+	return nil
+}
+
+func (n SettingsNotify) validate() []error {
+	errs := make([]error, 0)
+	if len(n.MqttTopic) > 0 {
+		if err := validatePublishTopic(n.MqttTopic); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt_topic: %w", err))
+		}
+	}
+	if len(n.Webhook) > 0 {
+		if err := validateWebhookUrl(n.Webhook); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	return errs
+}
+
+/* Every problem of a topic entry, the messages start with the key they are about */
+func (entry SettingsTopicEntry) validate() []error {
+	errs := make([]error, 0)
+
+	// the friendly name is part of the file names, it must not lead out of path
+	if strings.ContainsAny(entry.FriendlyName, `/\`) {
+		errs = append(errs, fmt.Errorf("friendly_name: %q contains a path separator", entry.FriendlyName))
+	}
+
+	if len(entry.Topic) == 0 {
+		errs = append(errs, errors.New("topic: required"))
+	} else if err := validateTopicFilter(entry.Topic); err != nil {
+		errs = append(errs, fmt.Errorf("topic: %w", err))
+	}
+
+	crons := []struct{ key, spec string }{
+		{"save_chart", entry.SaveChartCron},
+		{"save_json", entry.SaveStatsCron},
+		{"reset_data", entry.ResetStatsCron},
+		{"sample_chart", entry.SampleChartCron},
+		{"save_state", entry.SaveStateCron},
+	}
+	for _, c := range crons {
+		if len(c.spec) == 0 {
+			continue
+		}
+		if err := validateCron(c.spec); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.key, err))
+		}
+	}
+
+	patterns := []struct {
+		key string
+		raw []string
+	}{
+		{"exclude_topics", entry.IgnoreTopics},
+		{"include_topics", entry.IncludeTopics},
+	}
+	for _, p := range patterns {
+		for idx, raw := range p.raw {
+			if _, err := compileTopicPattern(raw); err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %w", p.key, idx, err))
+			}
+		}
+	}
+
+	if len(entry.StatsTopic) > 0 {
+		if err := validatePublishTopic(entry.StatsTopic); err != nil {
+			errs = append(errs, fmt.Errorf("stats_topic: %w", err))
+		}
+	}
+	if entry.StatsTopN < 0 {
+		errs = append(errs, errors.New("stats_top_n: can't be negative"))
+	}
+
+	if _, err := newSilenceWatch(entry); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newRollingWindows(entry.Windows, entry.WindowBucket, clock.Now()); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newChartDataHolder(entry); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
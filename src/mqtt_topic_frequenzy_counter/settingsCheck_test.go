@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const TEST_SETTINGS_INVALID = `url: mqtt://localhost:1883
+topics:
+  - topic: "zigbee2mqtt/#"
+    friendly_name: zigbee
+    save_json: "not a cron"
+  - topic: "a/#/b"
+    friendly_name: broken
+    retention:
+      - resolution: 1m
+        keep: 1h
+      - resolution: 1h
+        keep: 1d
+  - topic: "other/#"
+    friendly_name: zigbee
+alerts:
+  webhook: "ftp://example.com/hook"
+`
+
+func TestLoadSettingsLineNumbers(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "settings.yaml", TEST_SETTINGS_INVALID)
+	_, err := loadSettings(path, false, InfoLogger)
+	if err == nil {
+		t.Fatal("invalid settings were loaded")
+	}
+
+	// the line of the key the error is about, as deep as the message tells
+	want := map[string]string{
+		"topics[0] (zigbee): save_json: ":          "line 5: ",
+		"topics[1] (broken): topic: ":              "line 6: ",
+		"topics[1] (broken): retention[1]: keep: ": "line 12: ",
+		"topics[2] (zigbee): friendly_name: ":      "line 14: ",
+		"alerts: webhook: ":                        "line 16: ",
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(want) {
+		t.Errorf("%d errors, expected %d:\n%s", len(lines), len(want), err)
+	}
+	for key, prefix := range want {
+		found := false
+		for _, line := range lines {
+			if strings.Contains(line, key) {
+				found = true
+				if !strings.HasPrefix(line, prefix) {
+					t.Errorf("%q doesn't start with %q", line, prefix)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no error about %s in:\n%s", key, err)
+		}
+	}
+
+	var se SettingsError
+	if !errors.As(err, &se) {
+		t.Errorf("%T doesn't hold a SettingsError", err)
+	}
+}
+
+func TestLoadSettingsStrict(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "typo.yaml", "url: mqtt://localhost:1883\ntopics:\n  - topic: a/#\n    frendly_name: a\n")
+	if _, err := loadSettings(path, false, InfoLogger); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("an unknown key gave %v, expected an error on line 4", err)
+	}
+
+	path = writeTestFile(t, dir, "ok.yaml", "url: mqtt://localhost:1883\ntopics:\n  - topic: a/#\n")
+	s, err := loadSettings(path, false, InfoLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ClientID != "mqtt_topic_freq" || len(s.Topics) != 1 {
+		t.Errorf("settings %+v", s)
+	}
+
+	if _, err = loadSettings(filepath.Join(dir, "missing.yaml"), false, InfoLogger); err == nil {
+		t.Error("a missing file gave no error")
+	}
+}
+
+func TestSettingsErrorFullPath(t *testing.T) {
+	cases := []struct {
+		err  SettingsError
+		want []any
+	}{
+		{SettingsError{Path: []any{"topics", 1}, Err: errors.New("retention[2]: keep: too short")}, []any{"topics", 1, "retention", 2, "keep"}},
+		{SettingsError{Path: []any{"alerts"}, Err: errors.New("webhook: unknown scheme")}, []any{"alerts", "webhook"}},
+		{SettingsError{Err: errors.New("routing: unknown mode")}, []any{"routing"}},
+		{SettingsError{Path: []any{"topics", 0}, Err: errors.New("Both strings are empty")}, []any{"topics", 0}},
+	}
+	for _, c := range cases {
+		if got := c.err.fullPath(); !slices.Equal(got, c.want) {
+			t.Errorf("fullPath of %q = %v, expected %v", c.err.Err, got, c.want)
+		}
+	}
+
+	e := SettingsError{Path: []any{"topics", 1}, Label: "zigbee", Line: 7, Err: errors.New("topic: required")}
+	if got, want := e.Error(), "line 7: topics[1] (zigbee): topic: required"; got != want {
+		t.Errorf("Error() = %q, expected %q", got, want)
+	}
+}
+
+func TestNodeLine(t *testing.T) {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(TEST_SETTINGS_INVALID), &root); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path []any
+		line int
+	}{
+		{nil, 1},
+		{[]any{"url"}, 1},
+		{[]any{"topics", 1, "retention", 0, "keep"}, 10},
+		// missing keys & indices stop at the deepest node that exists
+		{[]any{"topics", 2, "save_chart"}, 13},
+		{[]any{"topics", 9}, 3},
+		{[]any{"homeassistant", "enabled"}, 1},
+	}
+	for _, c := range cases {
+		if got := nodeLine(&root, c.path); got != c.line {
+			t.Errorf("nodeLine(%v) = %d, expected %d", c.path, got, c.line)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+/*
+pattern: topic pattern, same syntax as exclude_topics
+interval: go duration (e.g. "90m"), a matching topic silent for longer raises an alert
+*/
+type SettingsExpectedInterval struct {
+	Pattern  string `yaml:"pattern"`
+	Interval string `yaml:"interval"`
+}
+
+type silenceRule struct {
+	pattern  topicPattern
+	interval time.Duration
+}
+
+/* Per topic expectations, the first matching rule wins, fallback applies to all other topics */
+type silenceWatch struct {
+	rules    []silenceRule
+	fallback time.Duration
+	alerted  map[string]bool
+}
+
+func newSilenceWatch(setting SettingsTopicEntry) (silenceWatch, error) {
+	w := silenceWatch{alerted: make(map[string]bool)}
+
+	if len(setting.ExpectedInterval) > 0 {
+		d, err := time.ParseDuration(setting.ExpectedInterval)
+		if err != nil {
+			return w, fmt.Errorf("expected_interval: %w", err)
+		}
+		w.fallback = d
+	}
+
+	for idx, entry := range setting.ExpectedIntervals {
+		p, err := compileTopicPattern(entry.Pattern)
+		if err != nil {
+			return w, fmt.Errorf("expected_intervals[%d]: %w", idx, err)
+		}
+		d, err := time.ParseDuration(entry.Interval)
+		if err != nil {
+			return w, fmt.Errorf("expected_intervals[%d]: %w", idx, err)
+		}
+		w.rules = append(w.rules, silenceRule{pattern: p, interval: d})
+	}
+	return w, nil
+}
+
+/* 0 means the topic is not watched */
+func (w *silenceWatch) intervalFor(topic string) time.Duration {
+	for _, r := range w.rules {
+		if r.pattern.match(topic) {
+			return r.interval
+		}
+	}
+	return w.fallback
+}
+
+func (w *silenceWatch) enabled() bool {
+	return w.fallback > 0 || len(w.rules) > 0
+}
+
+/* How often to look for silent topics, half the shortest interval but at most once a minute */
+func (w *silenceWatch) checkInterval() time.Duration {
+	shortest := w.fallback
+	for _, r := range w.rules {
+		if r.interval > 0 && (shortest == 0 || r.interval < shortest) {
+			shortest = r.interval
+		}
+	}
+
+	check := shortest / 2
+	if check > time.Minute {
+		check = time.Minute
+	}
+	if check < time.Second {
+		check = time.Second
+	}
+	return check
+}
+
+/* Internal function, expects _mutex to be held. Returns an alert if the topic was reported silent before */
+func (d *TopicProc) _markSeen(topic string, now time.Time) *Alert {
+	d.lastSeen[topic] = now
+
+	if !d._silence.alerted[topic] {
+		return nil
+	}
+	delete(d._silence.alerted, topic)
+	return &Alert{
+		Kind:         ALERT_RECOVERED,
+		FriendlyName: d.friendlyName,
+		Topic:        topic,
+		Message:      fmt.Sprintf("%s is publishing again", topic),
+		Time:         now,
+	}
+}
+
+/* Alerts once per topic, the topic has to publish again before it can alert again */
+func (d *TopicProc) checkSilence(now time.Time) []Alert {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	alerts := make([]Alert, 0)
+	for topic, seen := range d.lastSeen {
+		interval := d._silence.intervalFor(topic)
+		if interval <= 0 || d._silence.alerted[topic] {
+			continue
+		}
+		silent := now.Sub(seen)
+		if silent <= interval {
+			continue
+		}
+
+		d._silence.alerted[topic] = true
+		alerts = append(alerts, Alert{
+			Kind:         ALERT_SILENT,
+			FriendlyName: d.friendlyName,
+			Topic:        topic,
+			Message:      fmt.Sprintf("%s silent for %s (expected every %s)", topic, silent.Round(time.Second), interval),
+			Time:         now,
+		})
+	}
+	return alerts
+}
+
+func (d *TopicProc) scheduleSilenceCheck(sched gocron.Scheduler) error {
+	if !d._silence.enabled() {
+		return nil
+	}
+
+	var err error
+	d._job_silence, err = sched.NewJob(gocron.DurationJob(d._silence.checkInterval()), gocron.NewTask(
+		func() {
+			for _, a := range d.checkSilence(clock.Now()) {
+				a.dispatch(d.notify)
+			}
+		},
+	))
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSilenceAlertsOnce(t *testing.T) {
+	tp := newTestTopicProc(t, SettingsTopicEntry{
+		FriendlyName:      "t",
+		Topic:             "a/#",
+		ExpectedInterval:  "5m",
+		ExpectedIntervals: []SettingsExpectedInterval{{Pattern: "a/fast", Interval: "1m"}},
+	}, t.TempDir())
+	check := tp._silence.checkInterval()
+	if check != 30*time.Second {
+		t.Errorf("checked every %s, expected half of the shortest interval", check)
+	}
+	seen := func(topic string, at time.Time) *Alert {
+		tp._mutex.Lock()
+		defer tp._mutex.Unlock()
+		return tp._markSeen(topic, at)
+	}
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	seen("a/fast", start)
+	seen("a/slow", start)
+	// every check for 20 minutes, a/slow publishes every 2 minutes, a/fast went quiet
+	now := start
+	silent := make([]time.Time, 0)
+	for step := 1; step <= 40; step++ {
+		now = now.Add(check)
+		if step%4 == 0 {
+			seen("a/slow", now)
+		}
+		for _, a := range tp.checkSilence(now) {
+			if a.Kind != ALERT_SILENT || a.Topic != "a/fast" {
+				t.Errorf("alert %+v, only a/fast is silent", a)
+			}
+			silent = append(silent, a.Time)
+		}
+	}
+	if len(silent) != 1 || !silent[0].Equal(start.Add(90*time.Second)) {
+		t.Fatalf("silent alerts at %v, expected one at the first check after a minute", silent)
+	}
+
+	// publishing again recovers it, the next silence alerts again
+	if recovered := seen("a/fast", now); recovered == nil || recovered.Kind != ALERT_RECOVERED {
+		t.Errorf("recovery %+v", recovered)
+	}
+	now = now.Add(2 * time.Minute)
+	seen("a/slow", now)
+	if alerts := tp.checkSilence(now); len(alerts) != 1 || alerts[0].Topic != "a/fast" {
+		t.Errorf("alerts %+v after a/fast went quiet again", alerts)
+	}
+}
+
+func TestAlertDispatchWebhook(t *testing.T) {
+	received := make(chan Alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var a Alert
+		if err := json.Unmarshal(b, &a); err != nil {
+			t.Error(err)
+		}
+		received <- a
+	}))
+	defer srv.Close()
+
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	a := Alert{Kind: ALERT_SILENT, FriendlyName: "t", Topic: "a/fast", Message: "a/fast silent", Time: at}
+	a.dispatch(SettingsNotify{Webhook: srv.URL})
+	select {
+	case got := <-received:
+		if got.Kind != a.Kind || got.Topic != a.Topic || !got.Time.Equal(a.Time) {
+			t.Errorf("webhook got %+v", got)
+		}
+	default:
+		t.Fatal("the webhook got nothing")
+	}
+
+	// a replay only logs
+	replaying = true
+	t.Cleanup(func() { replaying = false })
+	a.dispatch(SettingsNotify{Webhook: srv.URL})
+	if len(received) != 0 {
+		t.Error("a replay called the webhook")
+	}
+}
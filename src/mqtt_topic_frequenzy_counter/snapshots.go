@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+One <friendly>_<RFC3339>.json file written by writeToJsonFile.
+Old files only hold the plain message map, newer ones a topicJsonOutput.
+Messages & Bytes are what arrived between Start and Time, see loadSnapshots.
+*/
+type snapshot struct {
+	Path     string
+	Start    time.Time
+	Time     time.Time
+	Messages topicByteMap
+	Bytes    topicByteMap
+	HasBytes bool
+
+	since *time.Time
+}
+
+/* Parses the time out of <friendly>_<RFC3339>.json, false for other files (e.g. the _total_ ones) */
+func snapshotFileTime(name string, friendlyName string) (time.Time, bool) {
+	rest, found := strings.CutPrefix(name, friendlyName+"_")
+	if !found {
+		return time.Time{}, false
+	}
+	rest, found = strings.CutSuffix(rest, ".json")
+	if !found {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, rest)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func readSnapshot(path string, fileTime time.Time) (snapshot, error) {
+	s := snapshot{Path: path, Time: fileTime, Messages: make(topicByteMap), Bytes: make(topicByteMap)}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	// the new format always has "until", an old plain map never has a key with a non numeric value
+	var out topicJsonOutput
+	if err = json.Unmarshal(b, &out); err == nil && !out.Until.IsZero() {
+		for topic, val := range out.Messages {
+			s.Messages[topic] = uint64(val)
+		}
+		for topic, val := range out.Bytes {
+			s.Bytes[topic] = val
+		}
+		s.HasBytes = true
+		s.Time = out.Until
+		s.since = out.Since
+		return s, nil
+	}
+
+	var plain topicMap
+	if err = json.Unmarshal(b, &plain); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	for topic, val := range plain {
+		s.Messages[topic] = uint64(val)
+	}
+	return s, nil
+}
+
+/* Every friendly name with at least one snapshot in dir */
+func snapshotNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	unique := UniqueStringArray{array: make(map[string]bool)}
+	for _, e := range entries {
+		name := e.Name()
+		idx := strings.LastIndex(name, "_")
+		if e.IsDir() || idx < 1 {
+			continue
+		}
+		// <friendly>_total_<RFC3339>.json holds the alltime counters
+		if _, ok := snapshotFileTime(name, name[:idx]); ok && !strings.HasSuffix(name[:idx], "_total") {
+			unique.AddString(name[:idx])
+		}
+	}
+	names, _ := unique.getStrings()
+	sort.Strings(names)
+	return names, nil
+}
+
+/*
+Loads the snapshots of friendlyName written within [from, to] (zero = open end), ordered by time.
+Afterwards every snapshot only holds what arrived since the one before:
+snapshots of one reset_data window share their since & grow, those become the
+difference to the previous one. A snapshot reaching back over the previous one
+with another since only counts with the share of its window after the previous one.
+Snapshots without reset_data already start where the one before ended.
+*/
+func loadSnapshots(dir string, friendlyName string, from time.Time, to time.Time) ([]snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]snapshot, 0)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		t, ok := snapshotFileTime(e.Name(), friendlyName)
+		if !ok {
+			continue
+		}
+		if (!from.IsZero() && t.Before(from)) || (!to.IsZero() && t.After(to)) {
+			continue
+		}
+		s, err := readSnapshot(filepath.Join(dir, e.Name()), t)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	// backwards, so the previous snapshot still holds its cumulative counts
+	for idx := len(snapshots) - 1; idx >= 0; idx-- {
+		s := &snapshots[idx]
+		switch {
+		case idx > 0 && s.since != nil && snapshots[idx-1].since != nil && s.since.Equal(*snapshots[idx-1].since):
+			prev := snapshots[idx-1]
+			s.Start = prev.Time
+			for topic, val := range s.Messages {
+				s.Messages[topic] = val - min(val, prev.Messages[topic])
+			}
+			for topic, val := range s.Bytes {
+				s.Bytes[topic] = val - min(val, prev.Bytes[topic])
+			}
+		case idx > 0 && s.since != nil && s.since.Before(snapshots[idx-1].Time) && s.Time.After(*s.since):
+			prev := snapshots[idx-1]
+			share := float64(s.Time.Sub(prev.Time)) / float64(s.Time.Sub(*s.since))
+			s.Start = prev.Time
+			for topic, val := range s.Messages {
+				s.Messages[topic] = uint64(math.Round(float64(val) * share))
+			}
+			for topic, val := range s.Bytes {
+				s.Bytes[topic] = uint64(math.Round(float64(val) * share))
+			}
+		case s.since != nil:
+			s.Start = *s.since
+		case idx > 0:
+			s.Start = snapshots[idx-1].Time
+		case len(snapshots) > 1:
+			// nothing tells when the first old window started, assume it was as long as the next one
+			s.Start = s.Time.Add(-snapshots[1].Time.Sub(s.Time))
+		default:
+			s.Start = s.Time
+		}
+	}
+	return snapshots, nil
+}
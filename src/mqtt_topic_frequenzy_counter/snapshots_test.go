@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshotFileTime(t *testing.T) {
+	cases := []struct {
+		name, friendly string
+		ok             bool
+	}{
+		{"zigbee_2024-03-01T12:00:00Z.json", "zigbee", true},
+		{"zigbee_2024-03-01T13:00:00+01:00.json", "zigbee", true},
+		{"zigbee_total_2024-03-01T12:00:00Z.json", "zigbee", false},
+		{"zigbee_2024-03-01T12:00:00Z.json", "zig", false},
+		{"zigbee_2024-03-01T12:00:00Z.html", "zigbee", false},
+		{"zigbee.state.json", "zigbee", false},
+	}
+	for _, c := range cases {
+		got, ok := snapshotFileTime(c.name, c.friendly)
+		if ok != c.ok {
+			t.Errorf("snapshotFileTime(%q, %q) ok %t, expected %t", c.name, c.friendly, ok, c.ok)
+		}
+		if ok && !got.Equal(testEpoch) {
+			t.Errorf("snapshotFileTime(%q) = %s, expected %s", c.name, got, testEpoch)
+		}
+	}
+}
+
+func TestReadSnapshotFormats(t *testing.T) {
+	dir := t.TempDir()
+	fileTime := testEpoch.Add(time.Minute)
+
+	plain := writeTestFile(t, dir, "old.json", `{"a/b": 3, "a/c": 7}`)
+	s, err := readSnapshot(plain, fileTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HasBytes || s.since != nil || !s.Time.Equal(fileTime) {
+		t.Errorf("old format: HasBytes %t, since %v, time %s", s.HasBytes, s.since, s.Time)
+	}
+	if s.Messages["a/b"] != 3 || s.Messages["a/c"] != 7 || len(s.Bytes) != 0 {
+		t.Errorf("old format: messages %v, bytes %v", s.Messages, s.Bytes)
+	}
+
+	current := writeTestFile(t, dir, "new.json", `{
+		"since": "2024-03-01T11:00:00Z",
+		"until": "2024-03-01T12:00:00Z",
+		"messages": {"a/b": 5},
+		"bytes": {"a/b": 500},
+		"rates": {"a/b": {"1m": {"messages": 1, "bytes": 100}}}
+	}`)
+	s, err = readSnapshot(current, fileTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasBytes || s.since == nil || !s.since.Equal(testEpoch.Add(-time.Hour)) {
+		t.Errorf("new format: HasBytes %t, since %v", s.HasBytes, s.since)
+	}
+	// the new format knows its own time better than the file name
+	if !s.Time.Equal(testEpoch) {
+		t.Errorf("new format: time %s, expected until %s", s.Time, testEpoch)
+	}
+	if s.Messages["a/b"] != 5 || s.Bytes["a/b"] != 500 {
+		t.Errorf("new format: messages %v, bytes %v", s.Messages, s.Bytes)
+	}
+
+	for name, content := range map[string]string{
+		"broken.json": `{"a/b": `,
+		"text.json":   `{"a/b": "many"}`,
+	} {
+		if _, err = readSnapshot(writeTestFile(t, dir, name, content), fileTime); err == nil {
+			t.Errorf("%s was read without an error", name)
+		}
+	}
+}
+
+func TestSnapshotNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"zigbee_2024-03-01T12:00:00Z.json",
+		"zigbee_2024-03-01T13:00:00Z.json",
+		"zigbee_total_2024-03-01T13:00:00Z.json",
+		"to_zigbee_2024-03-01T12:00:00Z.json",
+		"graph_zigbee_2024-03-01T12:00:00Z.html",
+		"zigbee.state.json",
+	} {
+		writeTestFile(t, dir, name, "{}")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir_2024-03-01T12:00:00Z.json"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := snapshotNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"to_zigbee", "zigbee"}; !slices.Equal(names, want) {
+		t.Errorf("snapshotNames = %q, expected %q", names, want)
+	}
+}
+
+func TestLoadSnapshotsOldFormat(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "z_2024-03-01T12:10:00Z.json", `{"a": 4}`)
+	writeTestFile(t, dir, "z_2024-03-01T12:00:00Z.json", `{"a": 2}`)
+	writeTestFile(t, dir, "z_2024-03-01T12:20:00Z.json", `{"a": 6}`)
+
+	snapshots, err := loadSnapshots(dir, "z", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("%d snapshots, expected 3", len(snapshots))
+	}
+	// old windows were reset, every file holds its own counts
+	wantStart := []time.Time{testEpoch.Add(-10 * time.Minute), testEpoch, testEpoch.Add(10 * time.Minute)}
+	wantMessages := []uint64{2, 4, 6}
+	for i, s := range snapshots {
+		if !s.Start.Equal(wantStart[i]) || s.Messages["a"] != wantMessages[i] {
+			t.Errorf("snapshot %d starts %s with %d messages, expected %s with %d", i, s.Start, s.Messages["a"], wantStart[i], wantMessages[i])
+		}
+	}
+
+	snapshots, err = loadSnapshots(dir, "z", testEpoch.Add(5*time.Minute), testEpoch.Add(15*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || !snapshots[0].Time.Equal(testEpoch.Add(10*time.Minute)) {
+		t.Errorf("from & to kept %d snapshots", len(snapshots))
+	}
+	// a single old snapshot doesn't know how long it is
+	if len(snapshots) == 1 && !snapshots[0].Start.Equal(snapshots[0].Time) {
+		t.Errorf("single snapshot starts %s, expected its own time", snapshots[0].Start)
+	}
+}
+
+func TestLoadSnapshotsOverlappingWindows(t *testing.T) {
+	dir := t.TempDir()
+	// sliding windows of an hour written every 20 minutes, each reaches back over the one before
+	writeTestFile(t, dir, "z_2024-03-01T12:00:00Z.json", `{"since": "2024-03-01T11:00:00Z", "until": "2024-03-01T12:00:00Z", "messages": {"a": 60}, "bytes": {"a": 600}}`)
+	writeTestFile(t, dir, "z_2024-03-01T12:20:00Z.json", `{"since": "2024-03-01T11:20:00Z", "until": "2024-03-01T12:20:00Z", "messages": {"a": 90}, "bytes": {"a": 900}}`)
+
+	snapshots, err := loadSnapshots(dir, "z", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("%d snapshots, expected 2", len(snapshots))
+	}
+	// only the last third of the second window is new
+	if s := snapshots[1]; !s.Start.Equal(testEpoch) || s.Messages["a"] != 30 || s.Bytes["a"] != 300 {
+		t.Errorf("second snapshot starts %s with %d messages & %d bytes, expected %s, 30 & 300", s.Start, s.Messages["a"], s.Bytes["a"], testEpoch)
+	}
+	if s := snapshots[0]; !s.Start.Equal(testEpoch.Add(-time.Hour)) || s.Messages["a"] != 60 {
+		t.Errorf("first snapshot starts %s with %d messages", s.Start, s.Messages["a"])
+	}
+}
+
+/* From the TopicProc over its snapshot files to the report, every message sent is counted once */
+func TestReportCountsWhatWasSent(t *testing.T) {
+	cases := []struct {
+		name                      string
+		entry                     SettingsTopicEntry
+		snapshotEvery, resetEvery int
+	}{
+		{"without reset_data", SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"}, 1, 0},
+		{"save_json every 5 minutes", SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"}, 5, 0},
+		{"with reset_data", SettingsTopicEntry{FriendlyName: "t", Topic: "a/#", ResetStatsCron: "0 0 * * * *"}, 10, 60},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newTopicFeed(t, c.entry)
+			f.run(180, 6, c.snapshotEvery, c.resetEvery)
+			sent := f.sent
+
+			snapshots, err := loadSnapshots(f.dir, "t", time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := buildReport("t", snapshots, time.Hour)
+			if len(r.Topics) != 1 {
+				t.Fatalf("%d topics in the report, expected 1", len(r.Topics))
+			}
+			topic := r.Topics[0]
+			if topic.Messages != sent || topic.Bytes != 10*sent {
+				t.Errorf("report counted %d messages & %d bytes, %d were sent", topic.Messages, topic.Bytes, sent)
+			}
+			if rate := r.perSecond(topic); rate < 0.099 || rate > 0.101 {
+				t.Errorf("rate %g, expected 0.1/s", rate)
+			}
+			if trend, ok := topic.trend(); !ok || trend < -5 || trend > 5 {
+				t.Errorf("trend %g (%t) of a steady topic", trend, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	STATE_VERSION      = 1
+	DEFAULT_STATE_CRON = "0 */5 * * * *"
+)
+
+type chartTierState struct {
+	Resolution string         `json:"resolution"`
+	Buckets    []*chartBucket `json:"buckets"`
+}
+
+/*
+Everything of a TopicProc that has to survive a restart.
+The current window (topicStore) is deliberately not part of it.
+*/
+type topicProcState struct {
+	Version       int                  `json:"version"`
+	FriendlyName  string               `json:"friendly_name"`
+	BaseTopic     string               `json:"base_topic"`
+	SavedAt       time.Time            `json:"saved_at"`
+	TotalMessages topicMap             `json:"total_messages"`
+	TotalBytes    topicByteMap         `json:"total_bytes"`
+	LastSeen      map[string]time.Time `json:"last_seen"`
+	History       []chartTierState     `json:"history"`
+}
+
+func (d *TopicProc) _stateFileName() string {
+	return d.friendlyName + ".state.json"
+}
+
+func (d *TopicProc) saveState() error {
+	d._mutex.Lock()
+	state := topicProcState{
+		Version:       STATE_VERSION,
+		FriendlyName:  d.friendlyName,
+		BaseTopic:     d.baseTopic,
+		SavedAt:       clock.Now(),
+		TotalMessages: d.topicStoreTotal,
+		TotalBytes:    d.topicBytesTotal,
+		LastSeen:      d.lastSeen,
+		History:       d.chart.toState(),
+	}
+	b, err := json.Marshal(state)
+	d._mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return d.fman.writeFileAtomic(d._stateFileName(), b)
+}
+
+/* A missing state file is not an error, we just start from zero */
+func (d *TopicProc) loadState() error {
+	b, err := d.fman.readFile(d._stateFileName())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state topicProcState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	if state.Version != STATE_VERSION {
+		return errors.New("state: unsupported version")
+	}
+
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	if state.TotalMessages != nil {
+		d.topicStoreTotal = state.TotalMessages
+	}
+	if state.TotalBytes != nil {
+		d.topicBytesTotal = state.TotalBytes
+	}
+	// Downtime is not the topics fault, silence is counted from the restart on
+	now := clock.Now()
+	for topic := range state.LastSeen {
+		d.lastSeen[topic] = now
+	}
+	d.chart.fromState(state.History, now)
+	d._log.Printf("State for %s restored from %s (saved at %s)\n", d.friendlyName, d._stateFileName(), state.SavedAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var stateTestEntry = SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"}
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	tp := newTestTopicProc(t, stateTestEntry, dir)
+	for i := 0; i < 3; i++ {
+		tp.process("a/b", 10)
+		tp.process("a/c", 5)
+		tp.chart.ChartPushData(map[string]uint32{"a/b": 1, "a/c": 1}, map[string]uint64{"a/b": 10, "a/c": 5})
+	}
+	if err := tp.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved topicProcState
+	b, err := os.ReadFile(filepath.Join(dir, "t.state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Version != STATE_VERSION || saved.FriendlyName != "t" || saved.BaseTopic != "a/#" {
+		t.Errorf("saved version %d of %q (%q)", saved.Version, saved.FriendlyName, saved.BaseTopic)
+	}
+
+	// loads the state on its own
+	loaded := newTestTopicProc(t, stateTestEntry, dir)
+	if loaded.topicStoreTotal["a/b"] != 3 || loaded.topicBytesTotal["a/b"] != 30 || loaded.topicStoreTotal["a/c"] != 3 || loaded.topicBytesTotal["a/c"] != 15 {
+		t.Errorf("totals %v & %v", loaded.topicStoreTotal, loaded.topicBytesTotal)
+	}
+	// the current window starts empty
+	if len(loaded.topicStore) != 0 {
+		t.Errorf("window %v restored", loaded.topicStore)
+	}
+	before, _ := json.Marshal(tp.chart.toState())
+	after, _ := json.Marshal(loaded.chart.toState())
+	if string(before) != string(after) {
+		t.Errorf("chart history changed\n%s\n%s", before, after)
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	// nothing saved yet
+	if err := newTestTopicProc(t, stateTestEntry, dir).loadState(); err != nil {
+		t.Errorf("missing state: %v", err)
+	}
+
+	tp := newTestTopicProc(t, stateTestEntry, dir)
+	tp.process("a/b", 10)
+	if err := tp.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "t.state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state map[string]any
+	if err = json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	state["version"] = STATE_VERSION + 1
+	future, _ := json.Marshal(state)
+
+	for name, content := range map[string][]byte{
+		"truncated":      b[:len(b)/2],
+		"corrupt":        []byte("not json"),
+		"future version": future,
+	} {
+		writeTestFile(t, dir, "t.state.json", string(content))
+		// a TopicProc starts from zero if its state can't be loaded
+		loaded := newTestTopicProc(t, stateTestEntry, dir)
+		if err := loaded.loadState(); err == nil {
+			t.Errorf("%s state was loaded without an error", name)
+		}
+		if len(loaded.topicStoreTotal) != 0 {
+			t.Errorf("%s state left totals %v", name, loaded.topicStoreTotal)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const DEFAULT_STATS_TOP_N = 10
+
+type topicSummaryEntry struct {
+	Topic             string                `json:"topic"`
+	Messages          uint32                `json:"messages"`
+	Bytes             uint64                `json:"bytes"`
+	MessagesPerSecond float64               `json:"messages_per_second"`
+	Rates             map[string]windowRate `json:"rates"`
+}
+
+/* What gets published to stats_topic */
+type topicSummary struct {
+	FriendlyName      string              `json:"friendly_name"`
+	BaseTopic         string              `json:"base_topic"`
+	Time              time.Time           `json:"time"`
+	WindowStart       time.Time           `json:"window_start"`
+	WindowSeconds     float64             `json:"window_seconds"`
+	Topics            int                 `json:"topics"`
+	Messages          uint64              `json:"messages"`
+	Bytes             uint64              `json:"bytes"`
+	MessagesPerSecond float64             `json:"messages_per_second"`
+	TotalMessages     uint64              `json:"total_messages"`
+	TotalBytes        uint64              `json:"total_bytes"`
+	Top               []topicSummaryEntry `json:"top"`
+}
+
+func perSecond(count uint64, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(count) / seconds
+}
+
+func (d *TopicProc) buildSummary(topN int, now time.Time) topicSummary {
+	rows := d.snapshotRows()
+	windowStart := d.currentWindowStart(now)
+
+	seconds := now.Sub(windowStart).Seconds()
+	summary := topicSummary{
+		FriendlyName:  d.friendlyName,
+		BaseTopic:     d.baseTopic,
+		Time:          now,
+		WindowStart:   windowStart,
+		WindowSeconds: seconds,
+		Top:           make([]topicSummaryEntry, 0, topN),
+	}
+
+	for _, row := range rows {
+		if row.Messages > 0 {
+			summary.Topics++
+		}
+		summary.Messages += uint64(row.Messages)
+		summary.Bytes += row.Bytes
+		summary.TotalMessages += uint64(row.TotalMessages)
+		summary.TotalBytes += row.TotalBytes
+	}
+	summary.MessagesPerSecond = perSecond(summary.Messages, seconds)
+
+	// busiest by the window the reported counts come from, the rolling windows only come along
+	windows := d.windowNames()
+	sortTopicRows(rows, "topic", true)
+	sortTopicRows(rows, "messages", false)
+	for _, row := range rows {
+		if len(summary.Top) >= topN || row.Messages == 0 {
+			break
+		}
+		rates := make(map[string]windowRate, len(windows))
+		for idx, rate := range row.Rates {
+			rates[windows[idx]] = rate
+		}
+		summary.Top = append(summary.Top, topicSummaryEntry{
+			Topic:             row.Topic,
+			Messages:          row.Messages,
+			Bytes:             row.Bytes,
+			MessagesPerSecond: perSecond(uint64(row.Messages), seconds),
+			Rates:             rates,
+		})
+	}
+	return summary
+}
+
+/* Publishes the summary retained to stats_topic, nothing happens without one */
+func (d *TopicProc) publishStats() error {
+	if len(d.statsTopic) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(d.buildSummary(d.statsTopN, clock.Now()))
+	if err != nil {
+		return err
+	}
+	return publishMessage(d.statsTopic, b, true)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildSummaryTop(t *testing.T) {
+	tp := newTestTopicProc(t, SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"}, t.TempDir())
+	for i := 0; i < 30; i++ {
+		tp.process("a/busy", 1)
+	}
+	tp.process("a/rare", 1)
+	for i := 0; i < 3; i++ {
+		tp.process("a/recent", 1)
+	}
+	tp.process("a/tie", 1)
+
+	summary := tp.buildSummary(3, time.Now())
+	if summary.Topics != 4 || summary.Messages != 35 {
+		t.Errorf("%d topics with %d messages, expected 4 with 35", summary.Topics, summary.Messages)
+	}
+	want := []struct {
+		topic    string
+		messages uint32
+	}{{"a/busy", 30}, {"a/recent", 3}, {"a/rare", 1}}
+	if len(summary.Top) != len(want) {
+		t.Fatalf("%d topics in the top, expected %d", len(summary.Top), len(want))
+	}
+	for i, w := range want {
+		if e := summary.Top[i]; e.Topic != w.topic || e.Messages != w.messages {
+			t.Errorf("top %d is %s with %d messages, expected %s with %d", i, e.Topic, e.Messages, w.topic, w.messages)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DEFAULT_STREAM_INTERVAL = 5 * time.Second
+	MIN_STREAM_INTERVAL     = time.Second
+	MAX_STREAM_EVENTS       = 1000
+	STREAM_EVENT_BUFFER     = 256
+	STREAM_WRITE_TIMEOUT    = 10 * time.Second
+)
+
+/* Sent once after connecting */
+type streamHello struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	Interval     float64   `json:"interval_seconds"`
+	Events       int       `json:"events_per_second"`
+	FriendlyName string    `json:"friendly_name,omitempty"`
+	Watches      []string  `json:"watches"`
+}
+
+type streamTopicDelta struct {
+	Messages          uint32  `json:"messages"`
+	Bytes             uint64  `json:"bytes"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+}
+
+/* Only topics with messages since the last delta */
+type streamWatchDelta struct {
+	FriendlyName string                      `json:"friendly_name"`
+	Topics       map[string]streamTopicDelta `json:"topics"`
+}
+
+/* What arrived within the last interval, DroppedEvents counts the raw events over the rate limit */
+type streamDelta struct {
+	Type          string             `json:"type"`
+	Time          time.Time          `json:"time"`
+	Seconds       float64            `json:"seconds"`
+	DroppedEvents uint64             `json:"dropped_events,omitempty"`
+	Watches       []streamWatchDelta `json:"watches"`
+}
+
+/* A single message, only sent if the client asked for ?events= */
+type streamEvent struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	FriendlyName string    `json:"friendly_name"`
+	Topic        string    `json:"topic"`
+	Bytes        int       `json:"bytes"`
+}
+
+type streamClient struct {
+	name   string
+	events chan streamEvent
+
+	// token bucket of the raw events, guarded by the hubs mutex
+	rate    float64
+	tokens  float64
+	last    time.Time
+	dropped uint64
+}
+
+/* Concurrent unsafe, hold the hubs mutex */
+func (c *streamClient) _allow(now time.Time) bool {
+	c.tokens = min(c.rate, c.tokens+now.Sub(c.last).Seconds()*c.rate)
+	c.last = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+/* Hands the raw events of the TopicProcs to the websocket clients asking for them */
+type streamHub struct {
+	mutex   sync.Mutex
+	clients map[*streamClient]bool
+	// clients with events, process skips the hub while there are none
+	active   atomic.Int32
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+var eventHub = streamHub{clients: make(map[*streamClient]bool), done: make(chan struct{})}
+
+func (h *streamHub) add(c *streamClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.clients[c] = true
+	if c.rate > 0 {
+		h.active.Add(1)
+	}
+}
+
+func (h *streamHub) remove(c *streamClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.clients, c)
+	if c.rate > 0 {
+		h.active.Add(-1)
+	}
+}
+
+/* Called by TopicProc.process, never blocks: slow clients lose events */
+func (h *streamHub) publish(name string, topic string, size int, now time.Time) {
+	if h.active.Load() == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for c := range h.clients {
+		if c.rate <= 0 || (len(c.name) > 0 && c.name != name) {
+			continue
+		}
+		if !c._allow(now) {
+			c.dropped++
+			continue
+		}
+		select {
+		case c.events <- streamEvent{Type: "message", Time: now, FriendlyName: name, Topic: topic, Bytes: size}:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+func (h *streamHub) takeDropped(c *streamClient) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dropped := c.dropped
+	c.dropped = 0
+	return dropped
+}
+
+/* Ends every stream, registered as shutdown hook of the http server */
+func (h *streamHub) close() {
+	h.doneOnce.Do(func() { close(h.done) })
+}
+
+/* Alltime counters at the last delta, per friendly name */
+type streamBaseline struct {
+	messages map[string]topicMap
+	bytes    map[string]topicByteMap
+}
+
+func (d *TopicProc) totalsCopy() (topicMap, topicByteMap) {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	msgs := make(topicMap, len(d.topicStoreTotal))
+	for key, val := range d.topicStoreTotal {
+		msgs[key] = val
+	}
+	bytes := make(topicByteMap, len(d.topicBytesTotal))
+	for key, val := range d.topicBytesTotal {
+		bytes[key] = val
+	}
+	return msgs, bytes
+}
+
+/*
+Differences of the alltime counters to the previous call, unaffected by resets.
+A TopicProc seen for the first time only sets its baseline, its restored state isn't news.
+*/
+func (b *streamBaseline) delta(name string, seconds float64) streamDelta {
+	res := streamDelta{Type: "delta", Seconds: seconds, Watches: make([]streamWatchDelta, 0)}
+	seen := make(map[string]bool)
+	for _, tp := range currentTopicProcs() {
+		if len(name) > 0 && tp.friendlyName != name {
+			continue
+		}
+		seen[tp.friendlyName] = true
+		msgs, bytes := tp.totalsCopy()
+		prevMsgs, found := b.messages[tp.friendlyName]
+		prevBytes := b.bytes[tp.friendlyName]
+		b.messages[tp.friendlyName] = msgs
+		b.bytes[tp.friendlyName] = bytes
+		if !found {
+			continue
+		}
+
+		wd := streamWatchDelta{FriendlyName: tp.friendlyName, Topics: make(map[string]streamTopicDelta)}
+		for topic, val := range msgs {
+			if val <= prevMsgs[topic] {
+				continue
+			}
+			td := streamTopicDelta{Messages: val - prevMsgs[topic]}
+			if nb := bytes[topic]; nb > prevBytes[topic] {
+				td.Bytes = nb - prevBytes[topic]
+			}
+			td.MessagesPerSecond = perSecond(uint64(td.Messages), seconds)
+			td.BytesPerSecond = perSecond(td.Bytes, seconds)
+			wd.Topics[topic] = td
+		}
+		res.Watches = append(res.Watches, wd)
+	}
+
+	// removed entries start over if they come back
+	for name := range b.messages {
+		if !seen[name] {
+			delete(b.messages, name)
+			delete(b.bytes, name)
+		}
+	}
+	return res
+}
+
+var streamUpgrader = websocket.Upgrader{}
+
+/*
+Websocket with a delta of every TopicProc each ?interval= (go duration, default 5s).
+?name= only streams that friendly name, ?events=N also sends up to N raw messages per second.
+*/
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	interval := DEFAULT_STREAM_INTERVAL
+	if raw := query.Get("interval"); len(raw) > 0 {
+		var err error
+		if interval, err = time.ParseDuration(raw); err != nil || interval < MIN_STREAM_INTERVAL {
+			http.Error(w, fmt.Sprintf("interval has to be a go duration of at least %s", MIN_STREAM_INTERVAL), http.StatusBadRequest)
+			return
+		}
+	}
+	events := 0
+	if raw := query.Get("events"); len(raw) > 0 {
+		var err error
+		if events, err = strconv.Atoi(raw); err != nil || events < 0 || events > MAX_STREAM_EVENTS {
+			http.Error(w, fmt.Sprintf("events has to be between 0 and %d", MAX_STREAM_EVENTS), http.StatusBadRequest)
+			return
+		}
+	}
+	name := query.Get("name")
+	if len(name) > 0 && findTopicProc(name) == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered
+		return
+	}
+	defer conn.Close()
+
+	now := clock.Now()
+	client := &streamClient{name: name, events: make(chan streamEvent, STREAM_EVENT_BUFFER), rate: float64(events), tokens: float64(events), last: now}
+	eventHub.add(client)
+	defer eventHub.remove(client)
+
+	// nothing is expected from the client, but reading handles pings & notices the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(v any) bool {
+		conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+		return conn.WriteJSON(v) == nil
+	}
+
+	baseline := streamBaseline{messages: make(map[string]topicMap), bytes: make(map[string]topicByteMap)}
+	hello := streamHello{Type: "hello", Time: now, Interval: interval.Seconds(), Events: events, FriendlyName: name}
+	hello.Watches = watchNames(currentTopicProcs())
+	if len(name) > 0 {
+		hello.Watches = []string{name}
+	}
+	baseline.delta(name, 0)
+	if !write(hello) {
+		return
+	}
+
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	last := now
+	for {
+		select {
+		case <-closed:
+			return
+		case <-eventHub.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(time.Second))
+			return
+		case ev := <-client.events:
+			if !write(ev) {
+				return
+			}
+		case now := <-ticker.Chan():
+			delta := baseline.delta(name, now.Sub(last).Seconds())
+			delta.Time = now
+			delta.DroppedEvents = eventHub.takeDropped(client)
+			last = now
+			if !write(delta) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/* Runs procs as the only TopicProcs for the rest of the test */
+func useTopicProcs(t *testing.T, procs ...*TopicProc) {
+	t.Helper()
+	topicProcsMutex.Lock()
+	saved := topicProcs
+	topicProcs = procs
+	topicProcsMutex.Unlock()
+	t.Cleanup(func() {
+		topicProcsMutex.Lock()
+		topicProcs = saved
+		topicProcsMutex.Unlock()
+	})
+}
+
+func newStreamTopicProc(t *testing.T, name string) *TopicProc {
+	t.Helper()
+	return newTestTopicProc(t, SettingsTopicEntry{FriendlyName: name, Topic: name + "/#"}, t.TempDir())
+}
+
+func TestStreamBaselineDelta(t *testing.T) {
+	useFakeClock(t, testEpoch)
+	a, b := newStreamTopicProc(t, "a"), newStreamTopicProc(t, "b")
+	// restored totals aren't news
+	a.process("a/x", 10)
+	useTopicProcs(t, a, b)
+
+	baseline := streamBaseline{messages: make(map[string]topicMap), bytes: make(map[string]topicByteMap)}
+	if d := baseline.delta("", 0); len(d.Watches) != 0 {
+		t.Errorf("first delta %+v, expected only the baseline", d.Watches)
+	}
+
+	for i := 0; i < 5; i++ {
+		a.process("a/x", 10)
+	}
+	a.process("a/y", 100)
+	d := baseline.delta("", 5)
+	if len(d.Watches) != 2 || d.Watches[0].FriendlyName != "a" || len(d.Watches[1].Topics) != 0 {
+		t.Fatalf("delta %+v, expected a & an empty b", d.Watches)
+	}
+	want := map[string]streamTopicDelta{
+		"a/x": {Messages: 5, Bytes: 50, MessagesPerSecond: 1, BytesPerSecond: 10},
+		"a/y": {Messages: 1, Bytes: 100, MessagesPerSecond: 0.2, BytesPerSecond: 20},
+	}
+	for topic, w := range want {
+		if got := d.Watches[0].Topics[topic]; got != w {
+			t.Errorf("%s: %+v, expected %+v", topic, got, w)
+		}
+	}
+
+	// a reset doesn't touch the alltime counters, nothing new arrived
+	a.ResetStats()
+	if d = baseline.delta("a", 5); len(d.Watches) != 1 || len(d.Watches[0].Topics) != 0 {
+		t.Errorf("delta after a reset %+v, expected nothing", d.Watches)
+	}
+
+	// b is removed & comes back, it starts with a new baseline
+	useTopicProcs(t, a)
+	baseline.delta("", 5)
+	if _, found := baseline.messages["b"]; found {
+		t.Error("the baseline of the removed b is kept")
+	}
+	b.process("b/x", 1)
+	useTopicProcs(t, a, b)
+	if d = baseline.delta("b", 5); len(d.Watches) != 0 {
+		t.Errorf("delta of the returned b %+v, expected only the baseline", d.Watches)
+	}
+}
+
+func TestStreamHubRateLimit(t *testing.T) {
+	fake := useFakeClock(t, testEpoch)
+	hub := streamHub{clients: make(map[*streamClient]bool), done: make(chan struct{})}
+	limited := &streamClient{events: make(chan streamEvent, 100), rate: 2, tokens: 2, last: clock.Now()}
+	other := &streamClient{name: "b", events: make(chan streamEvent, 100), rate: 100, tokens: 100, last: clock.Now()}
+	full := &streamClient{events: make(chan streamEvent, 1), rate: 100, tokens: 100, last: clock.Now()}
+	deltasOnly := &streamClient{events: make(chan streamEvent, 100), last: clock.Now()}
+	for _, c := range []*streamClient{limited, other, full, deltasOnly} {
+		hub.add(c)
+	}
+
+	for i := 0; i < 5; i++ {
+		hub.publish("a", "a/x", 1, clock.Now())
+	}
+	// the bucket refills at 2 per second
+	fake.Advance(time.Second)
+	for i := 0; i < 5; i++ {
+		hub.publish("a", "a/x", 1, clock.Now())
+	}
+
+	cases := []struct {
+		name              string
+		c                 *streamClient
+		received, dropped int
+	}{
+		{"limited", limited, 4, 6},
+		{"other name", other, 0, 0},
+		{"full buffer", full, 1, 9},
+		{"deltas only", deltasOnly, 0, 0},
+	}
+	for _, c := range cases {
+		if got := len(c.c.events); got != c.received {
+			t.Errorf("%s: %d events, expected %d", c.name, got, c.received)
+		}
+		if got := hub.takeDropped(c.c); got != uint64(c.dropped) {
+			t.Errorf("%s: %d dropped, expected %d", c.name, got, c.dropped)
+		}
+	}
+	if hub.takeDropped(limited) != 0 {
+		t.Error("the dropped events were counted twice")
+	}
+
+	for _, c := range []*streamClient{limited, other, full} {
+		hub.remove(c)
+	}
+	if hub.active.Load() != 0 {
+		t.Errorf("%d active clients left", hub.active.Load())
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+ca_file: PEM bundle used instead of the system roots to verify the broker
+cert_file, key_file: PEM client certificate & key for mutual TLS
+insecure_skip_verify: don't verify the broker certificate at all
+server_name: name expected in the broker certificate, defaults to the host of the url
+*/
+type SettingsTls struct {
+	CaFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name"`
+}
+
+func (s SettingsTls) isEmpty() bool {
+	return s == SettingsTls{}
+}
+
+/* Builds the tls.Config for the broker connection, nil if nothing is configured */
+func (s SettingsTls) tlsConfig() (*tls.Config, error) {
+	if s.isEmpty() {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if len(s.CaFile) > 0 {
+		pem, err := os.ReadFile(s.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: ca_file: no certificates found in %s", s.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(s.CertFile) > 0 || len(s.KeyFile) > 0 {
+		if len(s.CertFile) == 0 || len(s.KeyFile) == 0 {
+			return nil, errors.New("tls: cert_file and key_file have to be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* PEM files of a locally generated CA, a server certificate for broker.test & 127.0.0.1 and a client certificate */
+type testPKI struct {
+	dir        string
+	caFile     string
+	serverCert tls.Certificate
+	caPool     *x509.CertPool
+	clientCert string
+	clientKey  string
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, der
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	p := testPKI{dir: t.TempDir()}
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(time.Hour)
+
+	ca, caKey, caDER := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	p.caFile = filepath.Join(p.dir, "ca.pem")
+	writePEM(t, p.caFile, "CERTIFICATE", caDER)
+	p.caPool = x509.NewCertPool()
+	p.caPool.AddCert(ca)
+
+	_, serverKey, serverDER := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker.test"},
+		DNSNames:     []string{"broker.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	p.serverCert = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	_, clientKey, clientDER := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "mqtt_topic_freq"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	p.clientCert = filepath.Join(p.dir, "client.pem")
+	writePEM(t, p.clientCert, "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clientKey = filepath.Join(p.dir, "client.key")
+	writePEM(t, p.clientKey, "EC PRIVATE KEY", keyDER)
+	return p
+}
+
+/* A TLS server requiring a client certificate of the CA, answers "ok" after the handshake */
+func (p testPKI) serve(t *testing.T) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientCAs:    p.caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+/* Connects with cfg & reads the answer, with TLS 1.3 a rejected client certificate only shows up when reading */
+func dialTestServer(addr string, cfg *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	return err
+}
+
+func TestTlsConfigEmpty(t *testing.T) {
+	cfg, err := SettingsTls{}.tlsConfig()
+	if cfg != nil || err != nil {
+		t.Errorf("empty settings gave %v, %v instead of nil, nil", cfg, err)
+	}
+}
+
+func TestTlsConfigHandshake(t *testing.T) {
+	p := newTestPKI(t)
+	addr := p.serve(t)
+
+	cases := []struct {
+		name     string
+		settings SettingsTls
+		ok       bool
+	}{
+		{"mutual tls by ip", SettingsTls{CaFile: p.caFile, CertFile: p.clientCert, KeyFile: p.clientKey}, true},
+		{"server_name", SettingsTls{CaFile: p.caFile, CertFile: p.clientCert, KeyFile: p.clientKey, ServerName: "broker.test"}, true},
+		{"wrong server_name", SettingsTls{CaFile: p.caFile, CertFile: p.clientCert, KeyFile: p.clientKey, ServerName: "other.test"}, false},
+		{"without client certificate", SettingsTls{CaFile: p.caFile}, false},
+		{"system roots", SettingsTls{CertFile: p.clientCert, KeyFile: p.clientKey}, false},
+		{"insecure_skip_verify", SettingsTls{CertFile: p.clientCert, KeyFile: p.clientKey, InsecureSkipVerify: true}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := c.settings.tlsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MinVersion != tls.VersionTLS12 {
+				t.Errorf("MinVersion %x, expected TLS 1.2", cfg.MinVersion)
+			}
+			err = dialTestServer(addr, cfg)
+			if c.ok && err != nil {
+				t.Errorf("connecting failed: %s", err)
+			}
+			if !c.ok && err == nil {
+				t.Error("connecting worked, expected a failure")
+			}
+		})
+	}
+}
+
+func TestTlsConfigErrors(t *testing.T) {
+	p := newTestPKI(t)
+	garbage := filepath.Join(p.dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a pem file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(p.dir, "missing.pem")
+
+	cases := []struct {
+		name     string
+		settings SettingsTls
+		contains string
+	}{
+		{"missing ca_file", SettingsTls{CaFile: missing}, "ca_file"},
+		{"ca_file without pem", SettingsTls{CaFile: garbage}, "no certificates found"},
+		{"cert_file without key_file", SettingsTls{CertFile: p.clientCert}, "set together"},
+		{"key_file without cert_file", SettingsTls{KeyFile: p.clientKey}, "set together"},
+		{"missing cert_file", SettingsTls{CertFile: missing, KeyFile: p.clientKey}, "tls:"},
+		{"cert_file without pem", SettingsTls{CertFile: garbage, KeyFile: p.clientKey}, "tls:"},
+		{"key not matching", SettingsTls{CertFile: p.clientCert, KeyFile: p.caFile}, "tls:"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := c.settings.tlsConfig()
+			if err == nil {
+				t.Fatalf("expected an error, got %v", cfg)
+			}
+			if !strings.Contains(err.Error(), c.contains) {
+				t.Errorf("error %q doesn't mention %q", err, c.contains)
+			}
+		})
+	}
+}
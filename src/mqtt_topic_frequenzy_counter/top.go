@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	TOP_DEFAULT_INTERVAL = time.Second
+	TOP_DEFAULT_WINDOW   = 10 * time.Second
+	TOP_DEFAULT_TREND    = time.Minute
+	TOP_MIN_INTERVAL     = 100 * time.Millisecond
+	/* Characters of a sparkline, the trend is split into this many buckets */
+	TOP_TREND_BUCKETS = 30
+)
+
+const (
+	TOP_SORT_TOPIC     = "topic"
+	TOP_SORT_RATE      = "rate"
+	TOP_SORT_BYTES     = "bytes"
+	TOP_SORT_MESSAGES  = "messages"
+	TOP_SORT_LAST_SEEN = "last_seen"
+)
+
+/* In the order of the columns, keys 1-5 pick them */
+var TOP_SORT_COLUMNS = []string{TOP_SORT_RATE, TOP_SORT_BYTES, TOP_SORT_MESSAGES, TOP_SORT_LAST_SEEN, TOP_SORT_TOPIC}
+
+const TOP_HELP = "q quit  s/1-5 sort  r reverse  / filter  p pause  tab watch  j/k scroll"
+
+/* A topic as top shows it, counted since top started */
+type topTopic struct {
+	Topic    string
+	Messages uint32
+	Rate     windowRate
+	LastSeen time.Time
+	Trend    []uint64
+}
+
+/* Rates are of the first rolling window, the trend are the newest buckets of them */
+func (d *TopicProc) topTopics(trendBuckets int64, now time.Time) []topTopic {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	rows := make([]topTopic, 0, len(d.topicStoreTotal))
+	for topic, total := range d.topicStoreTotal {
+		rows = append(rows, topTopic{
+			Topic:    topic,
+			Messages: total,
+			Rate:     d._windows.rates(topic, now)[0],
+			LastSeen: d.lastSeen[topic],
+			Trend:    d._windows.recent(topic, trendBuckets, now),
+		})
+	}
+	return rows
+}
+
+/* Topics ascending, everything else busiest first, ties by topic */
+func sortTopTopics(rows []topTopic, column string, reverse bool) {
+	slices.SortStableFunc(rows, func(a, b topTopic) int {
+		c := 0
+		switch column {
+		case TOP_SORT_RATE:
+			c = cmpDesc(a.Rate.MessagesPerSecond, b.Rate.MessagesPerSecond)
+		case TOP_SORT_BYTES:
+			c = cmpDesc(a.Rate.BytesPerSecond, b.Rate.BytesPerSecond)
+		case TOP_SORT_MESSAGES:
+			c = cmpDesc(a.Messages, b.Messages)
+		case TOP_SORT_LAST_SEEN:
+			c = b.LastSeen.Compare(a.LastSeen)
+		}
+		if c == 0 {
+			c = strings.Compare(a.Topic, b.Topic)
+		}
+		if reverse {
+			return -c
+		}
+		return c
+	})
+}
+
+func cmpDesc[T int | uint32 | float64](a, b T) int {
+	switch {
+	case a > b:
+		return -1
+	case a < b:
+		return 1
+	}
+	return 0
+}
+
+/* TopicProcs for top: only counting, the rolling windows are the rate window & the trend */
+func newTopProcs(entries []SettingsTopicEntry, window time.Duration, trend time.Duration) ([]*TopicProc, int64, error) {
+	bucket := max(trend/TOP_TREND_BUCKETS, time.Second)
+	procs := make([]*TopicProc, 0, len(entries))
+	for _, entry := range entries {
+		entry.Windows = []string{window.String(), trend.String()}
+		entry.WindowBucket = bucket.String()
+		tp, err := newCountingTopicProc(entry, InfoLogger)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", entry.name(), err)
+		}
+		procs = append(procs, tp)
+	}
+	return procs, int64((trend + bucket - 1) / bucket), nil
+}
+
+/* Keeps the last line written to it, the error logger writes here while the table owns the screen */
+type topStatus struct {
+	mutex sync.Mutex
+	line  string
+}
+
+func (s *topStatus) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.line = strings.TrimSpace(string(p))
+	return len(p), nil
+}
+
+func (s *topStatus) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.line
+}
+
+/* What the screen shows, only used by the goroutine of topView.run */
+type topView struct {
+	procs        []*TopicProc
+	current      int
+	sort         int
+	reverse      bool
+	filter       string
+	editing      bool
+	paused       bool
+	offset       int
+	page         int
+	rows         []topTopic
+	updated      time.Time
+	window       time.Duration
+	trend        time.Duration
+	trendBuckets int64
+	status       *topStatus
+}
+
+/* Takes new rows of the current TopicProc, even if paused */
+func (v *topView) load(now time.Time) {
+	v.rows = v.procs[v.current].topTopics(v.trendBuckets, now)
+	v.updated = now
+}
+
+func (v *topView) refresh(now time.Time) {
+	if !v.paused {
+		v.load(now)
+	}
+}
+
+func (v *topView) switchWatch(step int) {
+	v.current = (v.current + step + len(v.procs)) % len(v.procs)
+	v.offset = 0
+	v.load(clock.Now())
+}
+
+func (v *topView) sortBy(column int) {
+	if v.sort == column {
+		v.reverse = !v.reverse
+		return
+	}
+	v.sort = column
+	v.reverse = false
+}
+
+/* Filtered & sorted copy of the rows */
+func (v *topView) visible() []topTopic {
+	rows := make([]topTopic, 0, len(v.rows))
+	for _, row := range v.rows {
+		if strings.Contains(row.Topic, v.filter) {
+			rows = append(rows, row)
+		}
+	}
+	sortTopTopics(rows, TOP_SORT_COLUMNS[v.sort], v.reverse)
+	return rows
+}
+
+/* Handles a single key (see splitKeys), true means quit */
+func (v *topView) key(k string) bool {
+	if k == "\x03" {
+		return true
+	}
+
+	if v.editing {
+		switch k {
+		case "\r", "\n":
+			v.editing = false
+		case "\x1b":
+			v.editing = false
+			v.filter = ""
+		case "\x7f", "\b":
+			if _, size := utf8.DecodeLastRuneInString(v.filter); size > 0 {
+				v.filter = v.filter[:len(v.filter)-size]
+			}
+		default:
+			if r, _ := utf8.DecodeRuneInString(k); r >= ' ' && r != utf8.RuneError {
+				v.filter += k
+			}
+		}
+		v.offset = 0
+		return false
+	}
+
+	switch k {
+	case "q":
+		return true
+	case "s":
+		v.sortBy((v.sort + 1) % len(TOP_SORT_COLUMNS))
+	case "S":
+		v.sortBy((v.sort + len(TOP_SORT_COLUMNS) - 1) % len(TOP_SORT_COLUMNS))
+	case "1", "2", "3", "4", "5":
+		v.sortBy(int(k[0] - '1'))
+	case "r":
+		v.reverse = !v.reverse
+	case "/":
+		v.editing = true
+	case "\x1b":
+		v.filter = ""
+		v.offset = 0
+	case "p", " ":
+		v.paused = !v.paused
+		if !v.paused {
+			v.load(clock.Now())
+		}
+	case "\t", "n", "\x1b[C":
+		v.switchWatch(1)
+	case "\x1b[Z", "N", "\x1b[D":
+		v.switchWatch(-1)
+	case "j", "\x1b[B":
+		v.offset++
+	case "k", "\x1b[A":
+		v.offset--
+	case "\x1b[6~":
+		v.offset += v.page
+	case "\x1b[5~":
+		v.offset -= v.page
+	case "g", "\x1b[H":
+		v.offset = 0
+	}
+	return false
+}
+
+/* Splits what a read returned into keys: escape sequences, a lone escape or single characters */
+func splitKeys(b []byte) []string {
+	keys := make([]string, 0, len(b))
+	for len(b) > 0 {
+		size := 1
+		if b[0] == 0x1b && len(b) > 2 && (b[1] == '[' || b[1] == 'O') {
+			// CSI & SS3 sequences end with a byte between @ and ~
+			size = 2
+			for size < len(b) && (b[size] < 0x40 || b[size] > 0x7e) {
+				size++
+			}
+			size = min(size+1, len(b))
+		} else if b[0] >= utf8.RuneSelf {
+			_, size = utf8.DecodeRune(b)
+		}
+		keys = append(keys, string(b[:size]))
+		b = b[size:]
+	}
+	return keys
+}
+
+func readKeys(r io.Reader, keys chan<- []string) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			keys <- splitKeys(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+/* Cuts s to width characters */
+func fitWidth(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	if width < 1 {
+		return ""
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+/* 1234567 -> 1.2M */
+func shortCount(v float64) string {
+	units := []string{"", "k", "M", "G", "T"}
+	idx := 0
+	for v >= 1000 && idx < len(units)-1 {
+		v /= 1000
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%.1f", v)
+	}
+	return fmt.Sprintf("%.1f%s", v, units[idx])
+}
+
+func shortAgo(seen time.Time, now time.Time) string {
+	if seen.IsZero() {
+		return "-"
+	}
+	ago := now.Sub(seen)
+	switch {
+	case ago < time.Second:
+		return "now"
+	case ago < time.Minute:
+		return fmt.Sprintf("%ds", int(ago.Seconds()))
+	case ago < time.Hour:
+		return fmt.Sprintf("%dm", int(ago.Minutes()))
+	}
+	return fmt.Sprintf("%dh", int(ago.Hours()))
+}
+
+/* The whole screen, one string per line */
+func (v *topView) lines(width int, height int) []string {
+	tp := v.procs[v.current]
+	rows := v.visible()
+
+	title := fmt.Sprintf("%s (%s) [%d/%d]  %s", tp.friendlyName, tp.baseTopic, v.current+1, len(v.procs), v.updated.Format(time.TimeOnly))
+	if v.paused {
+		title += "  PAUSED"
+	}
+	order := "desc"
+	if (TOP_SORT_COLUMNS[v.sort] == TOP_SORT_TOPIC) != v.reverse {
+		order = "asc"
+	}
+	info := fmt.Sprintf("%d topics", len(v.rows))
+	if len(v.filter) > 0 {
+		info += fmt.Sprintf(", %d matching %q", len(rows), v.filter)
+	}
+	info += fmt.Sprintf(", sort %s %s, rates over %s, trend over %s", TOP_SORT_COLUMNS[v.sort], order, v.window, v.trend)
+
+	out := []string{title, info, ""}
+	header := fmt.Sprintf("%9s %9s %9s %6s  %-*s  %s", "1 MSG/S", "2 B/S", "3 MSGS", "4 SEEN", TOP_TREND_BUCKETS, "TREND", "5 TOPIC")
+	out = append(out, header)
+
+	footer := []string{TOP_HELP}
+	if v.editing {
+		footer = []string{"filter: " + v.filter + "_"}
+	}
+	if status := v.status.String(); len(status) > 0 {
+		footer = append([]string{status}, footer...)
+	}
+
+	v.page = max(height-len(out)-len(footer), 1)
+	v.offset = max(min(v.offset, len(rows)-v.page), 0)
+	end := min(v.offset+v.page, len(rows))
+	for _, row := range rows[v.offset:end] {
+		out = append(out, fmt.Sprintf("%9.2f %9s %9d %6s  %-*s  %s",
+			row.Rate.MessagesPerSecond, shortCount(row.Rate.BytesPerSecond), row.Messages,
+			shortAgo(row.LastSeen, v.updated), TOP_TREND_BUCKETS, sparkline(row.Trend), row.Topic))
+	}
+	for len(out) < height-len(footer) {
+		out = append(out, "")
+	}
+	out = append(out, footer...)
+	// a screen too small for the header & footer shows what fits
+	out = out[:min(len(out), max(height, 0))]
+
+	for idx := range out {
+		out[idx] = fitWidth(out[idx], width)
+	}
+	return out
+}
+
+func (v *topView) draw(w io.Writer, fd int) {
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for idx, line := range v.lines(width, height) {
+		if idx > 0 {
+			// raw mode, a newline doesn't go back to the start of the line
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\x1b[K")
+	}
+	buf.WriteString("\x1b[J")
+	w.Write(buf.Bytes())
+}
+
+/* Redraws each interval & on keys until q or ctx is done, the terminal is in raw mode meanwhile */
+func (v *topView) run(ctx context.Context, interval time.Duration) error {
+	in := int(os.Stdin.Fd())
+	out := int(os.Stdout.Fd())
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(in, state)
+
+	// alternate screen without cursor, the shell gets its screen back afterwards
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan []string)
+	go readKeys(os.Stdin, keys)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	v.load(clock.Now())
+	for {
+		v.draw(os.Stdout, out)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-winch:
+		case now := <-ticker.Chan():
+			v.refresh(now)
+		case pressed, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, k := range pressed {
+				if v.key(k) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+/* Connects like run, but shows a live table of the topics instead of writing anything */
+func runTop(args []string) int {
+	parsed := ParsedArgs{command: COMMAND_TOP}
+	fs := flag.NewFlagSet(COMMAND_TOP, flag.ContinueOnError)
+	fs.StringVar(&parsed.settings, "config", os.Getenv(ENV_CONFIG), "settings file (default "+ETC_SETTINGS_PATH+", env "+ENV_CONFIG+")")
+	fs.StringVar(&parsed.mqttUrl, "url", os.Getenv(ENV_URL), "MQTT broker url, overrides url of the settings (env "+ENV_URL+")")
+	fs.StringVar(&parsed.username, "user", os.Getenv(ENV_USER), "MQTT user (env "+ENV_USER+")")
+	fs.StringVar(&parsed.password, "passwd", os.Getenv(ENV_PASSWORD), "MQTT password (env "+ENV_PASSWORD+")")
+	fs.Var(repeatedString{&parsed.topics}, "topic", "watch this topic filter without a config file, can be repeated")
+	name := fs.String("name", "", "friendly name to show first (default the first entry)")
+	interval := fs.Duration("interval", TOP_DEFAULT_INTERVAL, "time between refreshes")
+	window := fs.Duration("window", TOP_DEFAULT_WINDOW, "msg/s & B/s are averaged over this")
+	trend := fs.Duration("trend", TOP_DEFAULT_TREND, "time span of the sparklines")
+	sortBy := fs.String("sort", TOP_SORT_RATE, "column to sort by: "+strings.Join(TOP_SORT_COLUMNS, ", "))
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s top [flags]\n\nKeys: %s\n\n", os.Args[0], TOP_HELP)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		ErrorLogger.Printf("Unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+	if *interval < TOP_MIN_INTERVAL {
+		ErrorLogger.Printf("-interval has to be at least %s\n", TOP_MIN_INTERVAL)
+		return 2
+	}
+	sortColumn := slices.Index(TOP_SORT_COLUMNS, *sortBy)
+	if sortColumn < 0 {
+		ErrorLogger.Printf("Unknown sort column %q, use one of %s\n", *sortBy, strings.Join(TOP_SORT_COLUMNS, ", "))
+		return 2
+	}
+	if err := parsed.validate(); err != nil {
+		ErrorLogger.Println(err)
+		return 2
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		ErrorLogger.Println("top needs a terminal, scripts can use the http api or stats_topic")
+		return 2
+	}
+
+	settings, err := loadSettings(parsed.settings, false, InfoLogger)
+	if errors.Is(err, os.ErrNotExist) && len(parsed.settings) == 0 && len(parsed.topics) > 0 {
+		WarningLogger.Println(err)
+	} else if err != nil {
+		ErrorLogger.Printf("Invalid settings: %s\n", err)
+		return 1
+	}
+	settings.Topics = append(settings.Topics, parsed.topicEntries()...)
+	if len(settings.Topics) == 0 {
+		ErrorLogger.Println("Nothing to watch, configure topics or use --topic")
+		return 2
+	}
+
+	procs, trendBuckets, err := newTopProcs(settings.Topics, *window, *trend)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 2
+	}
+	view := &topView{procs: procs, sort: sortColumn, window: *window, trend: *trend, trendBuckets: trendBuckets, status: new(topStatus)}
+	if len(*name) > 0 {
+		view.current = slices.IndexFunc(procs, func(tp *TopicProc) bool { return tp.friendlyName == *name })
+		if view.current < 0 {
+			ErrorLogger.Printf("Unknown friendly name %q\n", *name)
+			return 2
+		}
+	}
+	for _, tp := range procs {
+		tp.subID = _takeSubID()
+		topicProcs = append(topicProcs, tp)
+	}
+
+	// the running service most likely uses the configured client id, the broker would disconnect it
+	settings.ClientID = fmt.Sprintf("%s top %d", getBetterStringNoErr(settings.ClientID, "Topic Analyzer"), os.Getpid())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the screen belongs to the table, only the last error makes it to the bottom line
+	InfoLogger.SetOutput(io.Discard)
+	WarningLogger.SetOutput(io.Discard)
+	fmt.Fprintf(os.Stderr, "Connecting to %s...\n", getBetterStringNoErr(parsed.mqttUrl, settings.Url))
+	conn, err := setupMqtt(parsed, settings, ctx)
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 1
+	}
+	ErrorLogger.SetOutput(view.status)
+	err = view.run(ctx, *interval)
+	ErrorLogger.SetOutput(os.Stderr)
+
+	stop()
+	<-conn.Done()
+	if err != nil {
+		ErrorLogger.Println(err)
+		return 1
+	}
+	return 0
+}
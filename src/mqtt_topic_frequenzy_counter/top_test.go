@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+/* A view of two watches, a with the topics a/slow, a/fast & a/big, b with nothing */
+func newTestTopView(t *testing.T) *topView {
+	t.Helper()
+	fake := useFakeClock(t, testEpoch)
+	procs, buckets, err := newTopProcs([]SettingsTopicEntry{{FriendlyName: "a", Topic: "a/#"}, {FriendlyName: "b", Topic: "b/#"}}, TOP_DEFAULT_WINDOW, TOP_DEFAULT_TREND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		procs[0].process("a/slow", 1)
+	}
+	fake.Advance(time.Minute)
+	for i := 0; i < 10; i++ {
+		procs[0].process("a/fast", 1)
+	}
+	procs[0].process("a/big", 1000)
+	fake.Advance(time.Second)
+
+	v := &topView{procs: procs, trendBuckets: buckets, window: TOP_DEFAULT_WINDOW, trend: TOP_DEFAULT_TREND, status: &topStatus{}}
+	v.load(clock.Now())
+	return v
+}
+
+func topicsOf(rows []topTopic) []string {
+	topics := make([]string, 0, len(rows))
+	for _, row := range rows {
+		topics = append(topics, row.Topic)
+	}
+	return topics
+}
+
+func TestSortTopTopics(t *testing.T) {
+	v := newTestTopView(t)
+	if len(v.rows) != 3 || v.trendBuckets != TOP_TREND_BUCKETS {
+		t.Fatalf("%d rows with %d trend buckets", len(v.rows), v.trendBuckets)
+	}
+
+	cases := []struct {
+		column  string
+		reverse bool
+		order   []string
+	}{
+		// a/slow is out of the rate window, a/big & a/fast tie on messages per second
+		{TOP_SORT_RATE, false, []string{"a/fast", "a/big", "a/slow"}},
+		{TOP_SORT_RATE, true, []string{"a/slow", "a/big", "a/fast"}},
+		{TOP_SORT_BYTES, false, []string{"a/big", "a/fast", "a/slow"}},
+		{TOP_SORT_MESSAGES, false, []string{"a/slow", "a/fast", "a/big"}},
+		{TOP_SORT_LAST_SEEN, false, []string{"a/big", "a/fast", "a/slow"}},
+		{TOP_SORT_TOPIC, false, []string{"a/big", "a/fast", "a/slow"}},
+		{TOP_SORT_TOPIC, true, []string{"a/slow", "a/fast", "a/big"}},
+	}
+	for _, c := range cases {
+		rows := slices.Clone(v.rows)
+		sortTopTopics(rows, c.column, c.reverse)
+		if got := topicsOf(rows); !slices.Equal(got, c.order) {
+			t.Errorf("sorted by %s (reverse %t): %q, expected %q", c.column, c.reverse, got, c.order)
+		}
+	}
+
+	// the trend ends with the newest bucket
+	for _, row := range v.rows {
+		if row.Topic == "a/fast" && (len(row.Trend) != TOP_TREND_BUCKETS || row.Trend[len(row.Trend)-1]+row.Trend[len(row.Trend)-2] != 10) {
+			t.Errorf("trend of a/fast %v", row.Trend)
+		}
+	}
+}
+
+func TestTopViewKeys(t *testing.T) {
+	v := newTestTopView(t)
+
+	for _, k := range []string{"s", "s"} {
+		v.key(k)
+	}
+	if TOP_SORT_COLUMNS[v.sort] != TOP_SORT_MESSAGES || v.reverse {
+		t.Errorf("sort %s reverse %t after s s", TOP_SORT_COLUMNS[v.sort], v.reverse)
+	}
+	// the current column again reverses it
+	v.key("3")
+	if !v.reverse {
+		t.Error("3 on the messages column didn't reverse it")
+	}
+	v.key("S")
+	if TOP_SORT_COLUMNS[v.sort] != TOP_SORT_BYTES || v.reverse {
+		t.Errorf("sort %s reverse %t after S", TOP_SORT_COLUMNS[v.sort], v.reverse)
+	}
+
+	// q is part of the filter while editing
+	for _, k := range splitKeys([]byte("/fqx\x7f\r")) {
+		if v.key(k) {
+			t.Fatalf("%q quit while editing", k)
+		}
+	}
+	if v.filter != "fq" || v.editing {
+		t.Errorf("filter %q, editing %t", v.filter, v.editing)
+	}
+	v.key("\x1b")
+	if v.filter != "" {
+		t.Errorf("escape left the filter %q", v.filter)
+	}
+	for _, k := range splitKeys([]byte("/fast\r")) {
+		v.key(k)
+	}
+	if got := topicsOf(v.visible()); !slices.Equal(got, []string{"a/fast"}) {
+		t.Errorf("visible %q with filter %q", got, v.filter)
+	}
+
+	v.key("p")
+	v.procs[0].process("a/new", 1)
+	v.refresh(clock.Now())
+	if !v.paused || len(v.rows) != 3 {
+		t.Errorf("paused %t with %d rows, the new topic showed up", v.paused, len(v.rows))
+	}
+	v.key("p")
+	if len(v.rows) != 4 {
+		t.Errorf("%d rows after unpausing, expected 4", len(v.rows))
+	}
+
+	v.key("\t")
+	if v.current != 1 || len(v.rows) != 0 {
+		t.Errorf("watch %d with %d rows after tab", v.current, len(v.rows))
+	}
+	v.key("\x1b[D")
+	if v.current != 0 {
+		t.Errorf("watch %d after left", v.current)
+	}
+
+	if !v.key("q") || !v.key("\x03") {
+		t.Error("q & ctrl-c have to quit")
+	}
+}
+
+func TestSplitKeys(t *testing.T) {
+	got := splitKeys([]byte("a\x1b[A\x1b[5~\x1bü\t"))
+	want := []string{"a", "\x1b[A", "\x1b[5~", "\x1b", "ü", "\t"}
+	if !slices.Equal(got, want) {
+		t.Errorf("splitKeys = %q, expected %q", got, want)
+	}
+}
+
+func TestTopViewLines(t *testing.T) {
+	v := newTestTopView(t)
+	for i := 0; i < 40; i++ {
+		v.procs[0].process(fmt.Sprintf("a/very/long/topic/name/number/%d/ü", i), 1)
+	}
+	v.load(clock.Now())
+	v.status.Write([]byte("something failed\n"))
+
+	for _, size := range [][2]int{{80, 24}, {40, 10}, {200, 60}, {5, 3}} {
+		width, height := size[0], size[1]
+		lines := v.lines(width, height)
+		if len(lines) != height {
+			t.Errorf("%dx%d: %d lines", width, height, len(lines))
+		}
+		for idx, line := range lines {
+			if n := utf8.RuneCountInString(line); n > width {
+				t.Errorf("%dx%d: line %d is %d wide: %q", width, height, idx, n, line)
+			}
+		}
+		if height >= 10 && !strings.HasPrefix(lines[len(lines)-2], "something failed") {
+			t.Errorf("%dx%d: status line %q", width, height, lines[len(lines)-2])
+		}
+	}
+
+	// scrolling stops at the last page
+	v.offset = 1000
+	lines := v.lines(200, 24)
+	if v.offset != 43-v.page || !strings.HasSuffix(lines[len(lines)-3], "a/slow") {
+		t.Errorf("offset %d with page %d of 43 rows, last row %q", v.offset, v.page, lines[len(lines)-3])
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"sort"
 	"strings"
@@ -12,7 +13,18 @@ import (
 	"github.com/go-co-op/gocron/v2"
 )
 
+const DEFAULT_SAMPLE_CRON = "0 * * * * *"
+
 type topicMap map[string]uint32
+type topicByteMap map[string]uint64
+
+type topicJsonOutput struct {
+	Since    *time.Time                       `json:"since,omitempty"`
+	Until    time.Time                        `json:"until"`
+	Messages topicMap                         `json:"messages"`
+	Bytes    topicByteMap                     `json:"bytes"`
+	Rates    map[string]map[string]windowRate `json:"rates"`
+}
 
 type TopicProc struct {
 	_log            *log.Logger
@@ -20,24 +32,47 @@ type TopicProc struct {
 	_job_chart      gocron.Job
 	_job_json       gocron.Job
 	_job_reset      gocron.Job
-	_exc_topics     []string
+	_job_state      gocron.Job
+	_job_silence    gocron.Job
+	_job_sample     gocron.Job
+	_exc_topics     topicMatcher
+	_inc_topics     topicMatcher
+	_silence        silenceWatch
+	_rules          ruleEngine
+	_ha             haDiscovery
+	_windows        rollingWindows
+	_sample_msgs    topicMap
+	_sample_bytes   topicByteMap
+	_snapshot_msgs  topicMap
+	_snapshot_bytes topicByteMap
+	_snapshot_since time.Time
+	_setting        SettingsTopicEntry
 	baseTopic       string
 	friendlyName    string
 	topicStore      topicMap
 	topicStoreTotal topicMap
+	topicBytes      topicByteMap
+	topicBytesTotal topicByteMap
+	lastSeen        map[string]time.Time
+	windowStart     time.Time
 	chart           ChartDataHolder
 	subID           int
 	fman            *fileman
+	notify          SettingsNotify
+	statsTopic      string
+	statsTopN       int
+	ha              SettingsHomeAssistant
 }
 
-func (d *TopicProc) process(topic string) bool {
+func (d *TopicProc) process(topic string, size int) bool {
 	d._mutex.Lock()
 	defer d._mutex.Unlock()
 
-	for _, s := range d._exc_topics {
-		if strings.Contains(topic, s) {
-			return true
-		}
+	if len(d._inc_topics) > 0 && !d._inc_topics.matchAny(topic) {
+		return true
+	}
+	if d._exc_topics.matchAny(topic) {
+		return true
 	}
 
 	val, ok := d.topicStore[topic]
@@ -52,34 +87,119 @@ func (d *TopicProc) process(topic string) bool {
 	} else {
 		d.topicStoreTotal[topic] = 1
 	}
+	d.topicBytes[topic] += uint64(size)
+	d.topicBytesTotal[topic] += uint64(size)
+
+	now := clock.Now()
+	d._windows.add(topic, size, now)
+	if recovered := d._markSeen(topic, now); recovered != nil {
+		go recovered.dispatch(d.notify)
+	}
+	for _, f := range d._rules.observe(d.friendlyName, topic, size, now) {
+		go f.alert.dispatch(f.notify)
+	}
+	eventHub.publish(d.friendlyName, topic, size, now)
 
 	return true
 }
 
 func (d *TopicProc) writeGraph() error {
-	d._mutex.Lock()
-	defer d._mutex.Unlock()
-
 	ff, err := d.fman.getFileWithTimestamp("graph", d.friendlyName, "html")
 	if err != nil {
 		return err
 	}
 	defer ff.Close()
 
-	return d.chart.GenChart(ff, d.friendlyName, time.Now().Format(time.RFC3339))
+	return d.renderChart(ff, "")
+}
+
+/* Empty resolution renders chart_resolution */
+func (d *TopicProc) renderChart(writer io.Writer, resolution string) error {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	now := clock.Now()
+	msgs, _, _ := d._current(now)
+	return d.chart.GenChart(writer, d.friendlyName, now.Format(time.RFC3339), resolution, msgs)
+}
+
+type topicRow struct {
+	Topic         string
+	Messages      uint32
+	Bytes         uint64
+	TotalMessages uint32
+	TotalBytes    uint64
+	LastSeen      time.Time
+	Rates         []windowRate
+}
+
+/*
+Internal function, cuncurrent unsafe.
+Counters of the current window: since the last reset with reset_data, otherwise
+the longest rolling window, as topicStore is never reset then & would count since the start.
+*/
+func (d *TopicProc) _current(now time.Time) (topicMap, topicByteMap, time.Time) {
+	if len(d._setting.ResetStatsCron) > 0 {
+		return d.topicStore, d.topicBytes, d.windowStart
+	}
+	return d._windows.longestSums(now)
+}
+
+/* Start of the window the Messages & Bytes of snapshotRows are counted in */
+func (d *TopicProc) currentWindowStart(now time.Time) time.Time {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+	_, _, since := d._current(now)
+	return since
+}
+
+/* Copy of the current counters, safe to use without holding the mutex */
+func (d *TopicProc) snapshotRows() []topicRow {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	now := clock.Now()
+	msgs, bytes, _ := d._current(now)
+	rows := make([]topicRow, 0, len(d.topicStoreTotal))
+	for topic, total := range d.topicStoreTotal {
+		rows = append(rows, topicRow{
+			Topic:         topic,
+			Messages:      msgs[topic],
+			Bytes:         bytes[topic],
+			TotalMessages: total,
+			TotalBytes:    d.topicBytesTotal[topic],
+			LastSeen:      d.lastSeen[topic],
+			Rates:         d._windows.rates(topic, now),
+		})
+	}
+	return rows
+}
+
+/* Names of the rolling windows, in the order of topicRow.Rates */
+func (d *TopicProc) windowNames() []string {
+	return d._windows.names
 }
 
 /* Internal function, cuncurrent unsafe */
-func (d *TopicProc) _getKeysSortedByValue() []string {
-	keys, _ := MapKeys(d.topicStore)
+func (d *TopicProc) _getRates(now time.Time) map[string]map[string]windowRate {
+	rates := make(map[string]map[string]windowRate, len(d._windows.counters))
+	for topic := range d._windows.counters {
+		rates[topic] = d._windows.namedRates(topic, now)
+	}
+	return rates
+}
+
+func keysSortedByValue(m topicMap) []string {
+	keys, _ := MapKeys(m)
 	sort.SliceStable(keys, func(i, j int) bool {
-		return d.topicStore[keys[i]] < d.topicStore[keys[j]]
+		return m[keys[i]] < m[keys[j]]
 	})
 	return keys
 }
 
+/* Internal function, cuncurrent unsafe */
 func (d *TopicProc) _getSortedByValue() topicMap {
-	sk := d._getKeysSortedByValue()
+	sk := keysSortedByValue(d.topicStore)
 	nm := make(topicMap, len(d.topicStore))
 	for _, key := range sk {
 		nm[key] = d.topicStore[key]
@@ -87,15 +207,29 @@ func (d *TopicProc) _getSortedByValue() topicMap {
 	return nm
 }
 
+func (d *TopicProc) _getBytesCopy() topicByteMap {
+	nm := make(topicByteMap, len(d.topicBytes))
+	for key, val := range d.topicBytes {
+		nm[key] = val
+	}
+	return nm
+}
+
 func (d *TopicProc) writeStatsConsole() {
 	d._mutex.Lock()
 	defer d._mutex.Unlock()
-	keys := d._getKeysSortedByValue()
+	now := clock.Now()
+	msgs, bytes, _ := d._current(now)
+	keys := keysSortedByValue(msgs)
 
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("========= BEGINN %s ========\n", d.friendlyName))
 	for _, k := range keys {
-		sb.WriteString(fmt.Sprintf("%3d: %s\n", d.topicStore[k], k))
+		sb.WriteString(fmt.Sprintf("%3d (%d bytes)", msgs[k], bytes[k]))
+		for idx, rate := range d._windows.rates(k, now) {
+			sb.WriteString(fmt.Sprintf(" %s: %.3f/s", d._windows.names[idx], rate.MessagesPerSecond))
+		}
+		sb.WriteString(fmt.Sprintf(": %s\n", k))
 	}
 	sb.WriteString(fmt.Sprintln("========= END ========"))
 	d._log.Print(sb.String())
@@ -116,7 +250,23 @@ func (d *TopicProc) writeToJsonFile(total bool) error {
 	d._mutex.Lock()
 	defer d._mutex.Unlock()
 
-	b, err_marshal := json.Marshal(d.topicStore)
+	now := clock.Now()
+	var out topicJsonOutput
+	switch {
+	case total:
+		out = topicJsonOutput{Until: now, Messages: d.topicStoreTotal, Bytes: d.topicBytesTotal, Rates: d._getRates(now)}
+	case len(d._setting.ResetStatsCron) > 0:
+		// snapshots of one window share its since, see loadSnapshots
+		out = topicJsonOutput{Since: &d.windowStart, Until: now, Messages: d.topicStore, Bytes: d.topicBytes, Rates: d._getRates(now)}
+	default:
+		// the rolling windows overlap, a snapshot holds what arrived since the one before
+		since := d._snapshot_since
+		msgs, bytes := d._totalsSince(d._snapshot_msgs, d._snapshot_bytes)
+		d._resetSnapshotBase(now)
+		out = topicJsonOutput{Since: &since, Until: now, Messages: msgs, Bytes: bytes, Rates: d._getRates(now)}
+	}
+
+	b, err_marshal := json.Marshal(out)
 	if err_marshal != nil {
 		log.Println(err_marshal)
 	}
@@ -132,40 +282,157 @@ func (d *TopicProc) _InitTopicProc() {
 	d._mutex = sync.Mutex{}
 	d.topicStore = make(topicMap, 20)
 	d.topicStoreTotal = make(topicMap, 20)
-	d.chart = ChartDataHolder{
-		timedData: make(map[time.Time]ChartTimeData),
-		topics: UniqueStringArray{
-			array: make(map[string]bool),
-		},
-	}
+	d.topicBytes = make(topicByteMap, 20)
+	d.topicBytesTotal = make(topicByteMap, 20)
+	d.lastSeen = make(map[string]time.Time, 20)
+	d.windowStart = clock.Now()
+	d._snapshot_since = d.windowStart
 	d.friendlyName = ""
 	d.fman = new(fileman)
 	d.fman.working_directory = ""
 }
 
-/* Important for Charting, pushes data to chart & resets */
+/*
+Important for Charting, pushes data to chart & resets.
+Without reset_data only a manual reset gets here, the chart has its samples
+already & the current window is the rolling one, so that starts over instead.
+*/
 func (d *TopicProc) ResetStats() {
 	d._mutex.Lock()
 	defer d._mutex.Unlock()
 
-	d.chart.ChartPushData(d._getSortedByValue())
+	if len(d._setting.ResetStatsCron) > 0 {
+		d.chart.ChartPushData(d._getSortedByValue(), d._getBytesCopy())
+	}
 	d.topicStore = make(topicMap, len(d.topicStore))
+	d.topicBytes = make(topicByteMap, len(d.topicBytes))
+	d.windowStart = clock.Now()
+	if len(d._setting.ResetStatsCron) > 0 {
+		d._windows.prune(d.windowStart)
+	} else {
+		d._windows.reset(d.windowStart)
+	}
+}
+
+/* Internal function, cuncurrent unsafe. Copies of the alltime counters, the base of a later _totalsSince */
+func (d *TopicProc) _copyTotals() (topicMap, topicByteMap) {
+	msgs := make(topicMap, len(d.topicStoreTotal))
+	for key, val := range d.topicStoreTotal {
+		msgs[key] = val
+	}
+	bytes := make(topicByteMap, len(d.topicBytesTotal))
+	for key, val := range d.topicBytesTotal {
+		bytes[key] = val
+	}
+	return msgs, bytes
+}
 
+/* Internal function, cuncurrent unsafe. What the alltime counters grew by since the base was copied */
+func (d *TopicProc) _totalsSince(baseMsgs topicMap, baseBytes topicByteMap) (topicMap, topicByteMap) {
+	msgs := make(topicMap)
+	for key, val := range d.topicStoreTotal {
+		if base := baseMsgs[key]; val > base {
+			msgs[key] = val - base
+		}
+	}
+	bytes := make(topicByteMap)
+	for key, val := range d.topicBytesTotal {
+		if base := baseBytes[key]; val > base {
+			bytes[key] = val - base
+		}
+	}
+	return msgs, bytes
 }
 
-func NewTopicProc(setting SettingsTopicEntry, sched gocron.Scheduler, log *log.Logger) (*TopicProc, error) {
-	name, err := getBetterString(setting.FriendlyName, setting.Topic)
+/* Internal function, cuncurrent unsafe */
+func (d *TopicProc) _resetSampleBase() {
+	d._sample_msgs, d._sample_bytes = d._copyTotals()
+}
+
+/* Internal function, cuncurrent unsafe. The next snapshot only holds what arrives from now on */
+func (d *TopicProc) _resetSnapshotBase(now time.Time) {
+	d._snapshot_msgs, d._snapshot_bytes = d._copyTotals()
+	d._snapshot_since = now
+}
+
+/* Pushes what arrived since the last sample to the chart, without resetting the counters */
+func (d *TopicProc) SampleStats() {
+	d._mutex.Lock()
+	defer d._mutex.Unlock()
+
+	msgs, bytes := d._totalsSince(d._sample_msgs, d._sample_bytes)
+	d.chart.ChartPushData(msgs, bytes)
+	d._resetSampleBase()
+	d._windows.prune(clock.Now())
+}
+
+/* A TopicProc that only counts: no state, no jobs & no files, see NewTopicProc for the full one */
+func newCountingTopicProc(setting SettingsTopicEntry, log *log.Logger) (*TopicProc, error) {
+	name, err := getBetterString(setting.name(), "")
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err = validateTopicFilter(setting.Topic); err != nil {
+		return nil, err
+	}
+
 	d := new(TopicProc)
 	d._log = log
 	d._InitTopicProc()
+	d._setting = setting
 	d.baseTopic = setting.Topic
 	d.friendlyName = name
-	d._exc_topics = setting.IgnoreTopics
+	d.statsTopic = setting.StatsTopic
+	d.statsTopN = DEFAULT_STATS_TOP_N
+	if setting.StatsTopN > 0 {
+		d.statsTopN = setting.StatsTopN
+	}
+	d._exc_topics, err = compileTopicPatterns(setting.IgnoreTopics)
+	if err != nil {
+		return nil, err
+	}
+	d._inc_topics, err = compileTopicPatterns(setting.IncludeTopics)
+	if err != nil {
+		return nil, err
+	}
+	d._silence, err = newSilenceWatch(setting)
+	if err != nil {
+		return nil, err
+	}
+	d._windows, err = newRollingWindows(setting.Windows, setting.WindowBucket, clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	d.chart, err = newChartDataHolder(setting)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func NewTopicProc(setting SettingsTopicEntry, sched gocron.Scheduler, fman *fileman, log *log.Logger) (_ *TopicProc, err error) {
+	d, err := newCountingTopicProc(setting, log)
+	if err != nil {
+		return nil, err
+	}
+	d.fman = fman
+	// the jobs created before an error would keep running without anybody to stop them
+	defer func() {
+		if err != nil {
+			d.stop(sched)
+		}
+	}()
+
+	// A replay starts from zero, the state of an earlier run would count its messages twice
+	if !replaying {
+		if err = d.loadState(); err != nil {
+			log.Printf("Loading state for %s failed, starting from zero: %s\n", d.friendlyName, err)
+		}
+	}
+	d._resetSampleBase()
+	d._resetSnapshotBase(clock.Now())
 
 	if len(setting.SaveChartCron) > 0 {
 		d._job_chart, err = sched.NewJob(gocron.CronJob(setting.SaveChartCron, true), gocron.NewTask(
@@ -188,6 +455,12 @@ func NewTopicProc(setting SettingsTopicEntry, sched gocron.Scheduler, log *log.L
 			func() {
 				d.writeStatsConsole()
 				d.writeToJsonFile(false)
+				if err := d.publishStats(); err != nil {
+					log.Printf("Publishing stats for %s failed: %s\n", d.friendlyName, err)
+				}
+				if err := d.publishHomeAssistant(); err != nil {
+					log.Printf("Publishing home assistant states for %s failed: %s\n", d.friendlyName, err)
+				}
 				jjnr, jjnre := d._job_json.NextRun()
 				log.Printf("StatsCron: UUID: %s, NextRun: %+v, NextRunErr: %+v\n", d._job_json.ID(), jjnr, jjnre)
 			},
@@ -218,5 +491,40 @@ func NewTopicProc(setting SettingsTopicEntry, sched gocron.Scheduler, log *log.L
 		log.Printf("ResetCron: UUID: %s, NextRun: %+v, NextRunErr: %+v\n", d._job_reset.ID(), jjnr, jjnre)
 	}
 
+	// Without the legacy reset_data the chart gets samples of what arrived in between
+	sampleCron := setting.SampleChartCron
+	if len(sampleCron) == 0 && len(setting.ResetStatsCron) == 0 {
+		sampleCron = DEFAULT_SAMPLE_CRON
+	}
+	if len(sampleCron) > 0 {
+		d._job_sample, err = sched.NewJob(gocron.CronJob(sampleCron, true), gocron.NewTask(
+			func() {
+				d.SampleStats()
+			},
+		))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stateCron := DEFAULT_STATE_CRON
+	if len(setting.SaveStateCron) > 0 {
+		stateCron = setting.SaveStateCron
+	}
+	d._job_state, err = sched.NewJob(gocron.CronJob(stateCron, true), gocron.NewTask(
+		func() {
+			if err := d.saveState(); err != nil {
+				log.Printf("Saving state for %s failed: %s\n", d.friendlyName, err)
+			}
+		},
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = d.scheduleSilenceCheck(sched); err != nil {
+		return nil, err
+	}
+
 	return d, nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const REGEX_PATTERN_PREFIX = "re:"
+
+/*
+A single include/exclude pattern, either a MQTT topic filter
+(plain topics match exactly, + and # work like in a subscription)
+or a regular expression when prefixed with "re:".
+*/
+type topicPattern struct {
+	raw    string
+	filter string
+	re     *regexp.Regexp
+}
+
+type topicMatcher []topicPattern
+
+type TopicFilterError struct {
+	Filter string
+	Reason string
+}
+
+func (e TopicFilterError) Error() string {
+	return fmt.Sprintf("invalid topic filter %q: %s", e.Filter, e.Reason)
+}
+
+/* Checks a MQTT topic filter against the rules from the spec (4.7) */
+func validateTopicFilter(filter string) error {
+	if len(filter) == 0 {
+		return TopicFilterError{Filter: filter, Reason: "empty"}
+	}
+
+	levels := strings.Split(filter, "/")
+	for idx, level := range levels {
+		if strings.Contains(level, "#") {
+			if level != "#" {
+				return TopicFilterError{Filter: filter, Reason: "# has to occupy a whole level"}
+			}
+			if idx != len(levels)-1 {
+				return TopicFilterError{Filter: filter, Reason: "# is only allowed as last level"}
+			}
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return TopicFilterError{Filter: filter, Reason: "+ has to occupy a whole level"}
+		}
+	}
+	return nil
+}
+
+/* Expects a valid filter, see validateTopicFilter */
+func topicMatchesFilter(filter string, topic string) bool {
+	// Wildcards don't match topics starting with $ (e.g. $SYS)
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for idx, fl := range filterLevels {
+		if fl == "#" {
+			return true
+		}
+		if idx >= len(topicLevels) {
+			return false
+		}
+		if fl != "+" && fl != topicLevels[idx] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func compileTopicPattern(raw string) (topicPattern, error) {
+	if expr, isRegex := strings.CutPrefix(raw, REGEX_PATTERN_PREFIX); isRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return topicPattern{}, TopicFilterError{Filter: raw, Reason: err.Error()}
+		}
+		return topicPattern{raw: raw, re: re}, nil
+	}
+
+	if err := validateTopicFilter(raw); err != nil {
+		return topicPattern{}, err
+	}
+	return topicPattern{raw: raw, filter: raw}, nil
+}
+
+func compileTopicPatterns(raw []string) (topicMatcher, error) {
+	m := make(topicMatcher, 0, len(raw))
+	for _, r := range raw {
+		p, err := compileTopicPattern(r)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, p)
+	}
+	return m, nil
+}
+
+func (p topicPattern) match(topic string) bool {
+	if p.re != nil {
+		return p.re.MatchString(topic)
+	}
+	return topicMatchesFilter(p.filter, topic)
+}
+
+func (m topicMatcher) matchAny(topic string) bool {
+	for _, p := range m {
+		if p.match(topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateTopicFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		valid  bool
+	}{
+		{"zigbee2mqtt/#", true},
+		{"zigbee2mqtt/+/set", true},
+		{"#", true},
+		{"+", true},
+		{"a/b/c", true},
+		{"/leading/slash", true},
+		{"", false},
+		{"a/#/b", false},
+		{"a/b#", false},
+		{"a/+b", false},
+		{"zigbee2mqtt_g/+_motion", false},
+	}
+	for _, c := range cases {
+		err := validateTopicFilter(c.filter)
+		if (err == nil) != c.valid {
+			t.Errorf("validateTopicFilter(%q) = %v, valid %t expected", c.filter, err, c.valid)
+		}
+		var tfe TopicFilterError
+		if err != nil && !errors.As(err, &tfe) {
+			t.Errorf("validateTopicFilter(%q) returned %T, not a TopicFilterError", c.filter, err)
+		}
+	}
+}
+
+func TestTopicMatchesFilter(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/b", "a/b", true},
+		{"+", "", true},
+		{"a/+", "a/", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, c := range cases {
+		if got := topicMatchesFilter(c.filter, c.topic); got != c.match {
+			t.Errorf("topicMatchesFilter(%q, %q) = %t, expected %t", c.filter, c.topic, got, c.match)
+		}
+	}
+}
+
+func TestCompileTopicPattern(t *testing.T) {
+	cases := []struct {
+		raw   string
+		topic string
+		match bool
+	}{
+		{"zigbee2mqtt/bridge/#", "zigbee2mqtt/bridge/logging", true},
+		{"zigbee2mqtt/bridge/#", "zigbee2mqtt/lamp", false},
+		{"re:^zigbee2mqtt_g/[^/]+_motion$", "zigbee2mqtt_g/hall_motion", true},
+		{"re:^zigbee2mqtt_g/[^/]+_motion$", "zigbee2mqtt_g/hall/x_motion", false},
+		// regular expressions aren't anchored on their own
+		{"re:motion", "zigbee2mqtt_g/hall_motion/state", true},
+	}
+	for _, c := range cases {
+		p, err := compileTopicPattern(c.raw)
+		if err != nil {
+			t.Fatalf("compileTopicPattern(%q): %s", c.raw, err)
+		}
+		if got := p.match(c.topic); got != c.match {
+			t.Errorf("%q.match(%q) = %t, expected %t", c.raw, c.topic, got, c.match)
+		}
+	}
+
+	for _, raw := range []string{"re:(", "a/#/b", "a+"} {
+		if _, err := compileTopicPattern(raw); err == nil {
+			t.Errorf("compileTopicPattern(%q) accepted an invalid pattern", raw)
+		}
+	}
+}
+
+func TestCompileTopicPatternsMatchAny(t *testing.T) {
+	m, err := compileTopicPatterns([]string{"a/+", "re:^b/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string]bool{"a/x": true, "b/x/y": true, "a/x/y": false, "c": false} {
+		if got := m.matchAny(topic); got != want {
+			t.Errorf("matchAny(%q) = %t, expected %t", topic, got, want)
+		}
+	}
+
+	if _, err := compileTopicPatterns([]string{"a/+", "a/#/b"}); err == nil {
+		t.Error("compileTopicPatterns accepted an invalid pattern")
+	}
+	if m, err := compileTopicPatterns(nil); err != nil || m.matchAny("a") {
+		t.Errorf("an empty matcher matched or failed: %v", err)
+	}
+}
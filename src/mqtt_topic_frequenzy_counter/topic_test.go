@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+/* A TopicProc writing its files to a temp dir, on a fake clock starting at testEpoch */
+type topicFeed struct {
+	t    *testing.T
+	fake clockwork.FakeClock
+	tp   *TopicProc
+	dir  string
+	sent uint64
+}
+
+func newTopicFeed(t *testing.T, entry SettingsTopicEntry) *topicFeed {
+	t.Helper()
+	f := &topicFeed{t: t, fake: useFakeClock(t, testEpoch), dir: t.TempDir()}
+	f.tp = newTestTopicProc(t, entry, f.dir)
+	return f
+}
+
+/*
+Sends perMinute messages of 10 bytes to topic a/b every minute, evenly spread,
+writes a snapshot every snapshotEvery minutes & resets every resetEvery minutes (0 = never).
+*/
+func (f *topicFeed) run(minutes int, perMinute int, snapshotEvery int, resetEvery int) {
+	f.t.Helper()
+	step := time.Minute / time.Duration(perMinute)
+	for minute := 1; minute <= minutes; minute++ {
+		for i := 0; i < perMinute; i++ {
+			f.fake.Advance(step)
+			f.tp.process("a/b", 10)
+			f.sent++
+		}
+		if minute%snapshotEvery == 0 {
+			if err := f.tp.writeToJsonFile(false); err != nil {
+				f.t.Fatal(err)
+			}
+		}
+		if resetEvery > 0 && minute%resetEvery == 0 {
+			f.tp.ResetStats()
+		}
+	}
+}
+
+/* The snapshots as written, ordered by time */
+func (f *topicFeed) outputs() []topicJsonOutput {
+	f.t.Helper()
+	paths, err := filepath.Glob(filepath.Join(f.dir, f.tp.friendlyName+"_*.json"))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	outs := make([]topicJsonOutput, 0, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		var out topicJsonOutput
+		if err = json.Unmarshal(b, &out); err != nil {
+			f.t.Fatal(err)
+		}
+		outs = append(outs, out)
+	}
+	sort.Slice(outs, func(i, j int) bool { return outs[i].Until.Before(outs[j].Until) })
+	return outs
+}
+
+func TestSnapshotsWithoutResetDontOverlap(t *testing.T) {
+	f := newTopicFeed(t, SettingsTopicEntry{FriendlyName: "t", Topic: "a/#"})
+	f.run(180, 6, 1, 0)
+
+	outs := f.outputs()
+	if len(outs) != 180 {
+		t.Fatalf("%d snapshots, expected 180", len(outs))
+	}
+	var messages, bytes uint64
+	since := testEpoch
+	for i, out := range outs {
+		if out.Since == nil || !out.Since.Equal(since) {
+			t.Fatalf("snapshot %d starts at %v, expected the end of the one before %s", i, out.Since, since)
+		}
+		if out.Messages["a/b"] != 6 {
+			t.Errorf("snapshot %d holds %d messages, expected the 6 of its minute", i, out.Messages["a/b"])
+		}
+		since = out.Until
+		messages += uint64(out.Messages["a/b"])
+		bytes += out.Bytes["a/b"]
+	}
+	if messages != f.sent || bytes != 10*f.sent {
+		t.Errorf("the snapshots add up to %d messages & %d bytes, %d were sent", messages, bytes, f.sent)
+	}
+	// the rates still come from the rolling windows
+	if rate := outs[len(outs)-1].Rates["a/b"]["1h"].MessagesPerSecond; rate < 0.099 || rate > 0.101 {
+		t.Errorf("1h rate %g, expected 0.1/s", rate)
+	}
+}
+
+func TestSnapshotsWithResetShareTheirWindow(t *testing.T) {
+	f := newTopicFeed(t, SettingsTopicEntry{FriendlyName: "t", Topic: "a/#", ResetStatsCron: "0 0 * * * *"})
+	f.run(120, 6, 10, 60)
+
+	outs := f.outputs()
+	if len(outs) != 12 {
+		t.Fatalf("%d snapshots, expected 12", len(outs))
+	}
+	for i, out := range outs {
+		// the reset right after the snapshot at minute 60 begins a new window
+		since := testEpoch
+		if i >= 6 {
+			since = testEpoch.Add(time.Hour)
+		}
+		if out.Since == nil || !out.Since.Equal(since) {
+			t.Errorf("snapshot %d starts at %v, expected %s", i, out.Since, since)
+		}
+		if want := uint32(60 * (i%6 + 1)); out.Messages["a/b"] != want {
+			t.Errorf("snapshot %d holds %d messages, expected the %d of the window so far", i, out.Messages["a/b"], want)
+		}
+	}
+}